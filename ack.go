@@ -0,0 +1,318 @@
+package logstash
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The acknowledged mode speaks version 2 of the Lumberjack protocol, as
+// implemented by Logstash's beats input: a window frame announces the size
+// of a batch, each event is sent as a JSON frame with a sequence number, and
+// the server acknowledges the highest sequence number it has processed.
+const (
+	lumberjackVersion = '2'
+	lumberjackWindow  = 'W'
+	lumberjackJSON    = 'J'
+	lumberjackAck     = 'A'
+)
+
+const (
+	defaultAckWindow  = 256
+	defaultAckTimeout = 30 * time.Second
+	defaultAckFlush   = time.Second
+)
+
+// ackTransport is used in place of logspout's tcp transport when the ack
+// option is set. Each adapter has its own.
+type ackTransport struct {
+	// unacked holds the events of closed connections that were never
+	// acknowledged. The sender closes a connection to replace it after an
+	// error or ack timeout, so they are resent first on the next one.
+	mu      sync.Mutex
+	unacked [][]byte
+}
+
+// Dial implements the router.AdapterTransport interface.
+func (t *ackTransport) Dial(addr string, options map[string]string) (net.Conn, error) {
+	d, err := newDialer(options)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ackConn{
+		addr:      addr,
+		dialer:    d,
+		transport: t,
+		done:      make(chan struct{}),
+	}
+
+	if c.window, err = intOption(options, "ack_window", defaultAckWindow); err != nil {
+		return nil, err
+	}
+	if c.timeout, err = durationOption(options, "ack_timeout", defaultAckTimeout); err != nil {
+		return nil, err
+	}
+	if c.flushInterval, err = durationOption(options, "ack_flush_interval", defaultAckFlush); err != nil {
+		return nil, err
+	}
+
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	c.pending, t.unacked = t.unacked, nil
+	t.mu.Unlock()
+
+	go c.flushLoop()
+
+	return c, nil
+}
+
+// ackConn delivers events at least once: events stay queued until the
+// server acknowledges them, and unacknowledged events are resent on a new
+// connection after an error or timeout.
+type ackConn struct {
+	addr          string
+	dialer        *dialer
+	transport     *ackTransport
+	window        int
+	timeout       time.Duration
+	flushInterval time.Duration
+
+	mu      sync.Mutex
+	conn    net.Conn
+	reader  *bufio.Reader
+	pending [][]byte
+	done    chan struct{}
+	closed  bool
+}
+
+// connect dials a new connection.
+// It must be called with c.mu held, or before c is shared.
+func (c *ackConn) connect() error {
+	conn, err := c.dialer.dial(c.addr)
+	if err != nil {
+		return err
+	}
+
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	return nil
+}
+
+// drop closes the current connection.
+// It must be called with c.mu held.
+func (c *ackConn) drop() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// Write implements net.Conn. The event is queued and a full window is sent
+// before Write returns. An error means the event was not queued, because a
+// full window is still waiting to be acknowledged.
+func (c *ackConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, errors.New("logstash_ack: use of closed connection")
+	}
+
+	if len(c.pending) >= c.window {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	// The caller reuses p once Write returns.
+	c.pending = append(c.pending, append([]byte(nil), p...))
+
+	if len(c.pending) >= c.window {
+		if err := c.flush(); err != nil {
+			logWarn("logstash_ack:", err)
+		}
+	}
+
+	return len(p), nil
+}
+
+// flushLoop sends partial windows every flushInterval.
+func (c *ackConn) flushLoop() {
+	ticker := time.NewTicker(c.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		if err := c.flush(); err != nil {
+			logWarn("logstash_ack:", err)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// flush sends the queued events a window at a time, removing them from the
+// queue as they are acknowledged.
+// It must be called with c.mu held.
+func (c *ackConn) flush() error {
+	for len(c.pending) > 0 {
+		if c.conn == nil {
+			if err := c.connect(); err != nil {
+				return err
+			}
+		}
+
+		batch := c.pending
+		if len(batch) > c.window {
+			batch = batch[:c.window]
+		}
+
+		acked, err := c.send(batch)
+		c.pending = c.pending[acked:]
+		if err != nil {
+			c.drop()
+			return err
+		}
+	}
+
+	// Release the memory of a fully acknowledged queue.
+	c.pending = nil
+	return nil
+}
+
+// send writes one window and waits for it to be acknowledged, returning
+// how many events at the front of batch were acknowledged.
+func (c *ackConn) send(batch [][]byte) (int, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	writer := bufio.NewWriter(c.conn)
+
+	var header [10]byte
+	header[0], header[1] = lumberjackVersion, lumberjackWindow
+	binary.BigEndian.PutUint32(header[2:6], uint32(len(batch)))
+	writer.Write(header[:6])
+
+	for i, event := range batch {
+		header[0], header[1] = lumberjackVersion, lumberjackJSON
+		binary.BigEndian.PutUint32(header[2:6], uint32(i+1))
+		binary.BigEndian.PutUint32(header[6:10], uint32(len(event)))
+		writer.Write(header[:10])
+		writer.Write(event)
+	}
+
+	if err := writer.Flush(); err != nil {
+		return 0, err
+	}
+
+	acked := 0
+	for acked < len(batch) {
+		var ack [6]byte
+		if _, err := io.ReadFull(c.reader, ack[:]); err != nil {
+			return acked, err
+		}
+		if ack[0] != lumberjackVersion || ack[1] != lumberjackAck {
+			return acked, errors.New("logstash_ack: unexpected frame from server")
+		}
+
+		// Logstash sends acks for sequence 0 as a keepalive while it is
+		// still processing a window.
+		seq := int(binary.BigEndian.Uint32(ack[2:]))
+		if seq > len(batch) {
+			return acked, errors.New("logstash_ack: acknowledgement out of range")
+		}
+		if seq > acked {
+			acked = seq
+		}
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	c.conn.SetDeadline(time.Time{})
+	return acked, nil
+}
+
+// Read is not supported; acknowledgements are read by Write.
+func (c *ackConn) Read(p []byte) (int, error) {
+	return 0, errors.New("logstash_ack: read not supported")
+}
+
+// Close tries to deliver the queued events and closes the connection. The
+// events still unacknowledged are handed to the next connection dialed by
+// the transport.
+func (c *ackConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+
+	// After a failed window the connection is closed to be replaced, so
+	// the events aren't sent again until then.
+	var err error
+	if c.conn != nil {
+		err = c.flush()
+	}
+	c.drop()
+
+	if len(c.pending) > 0 {
+		logWarn("logstash_ack:", len(c.pending), "unacknowledged events will be resent on the next connection")
+		c.transport.mu.Lock()
+		c.transport.unacked = append(c.transport.unacked, c.pending...)
+		c.transport.mu.Unlock()
+		c.pending = nil
+	}
+
+	return err
+}
+
+// LocalAddr implements net.Conn.
+func (c *ackConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn.
+func (c *ackConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline implements net.Conn.
+func (c *ackConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *ackConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *ackConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,277 @@
+package logstash
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// beatsServer is a fake Logstash beats input. For every window it receives,
+// acks returns the sequence numbers to acknowledge it with, given the number
+// of the connection it arrived on; the connection is closed after them
+// unless the last one acknowledges the whole window.
+type beatsServer struct {
+	net.Listener
+
+	mu      sync.Mutex
+	windows [][]string
+	conns   []int
+}
+
+func newBeatsServer(t *testing.T, acks func(conn int, window []string) []uint32) *beatsServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &beatsServer{Listener: ln}
+
+	go func() {
+		for conn := 1; ; conn++ {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.serve(t, conn, c, acks)
+		}
+	}()
+
+	return s
+}
+
+func (s *beatsServer) serve(t *testing.T, conn int, c net.Conn, acks func(conn int, window []string) []uint32) {
+	defer c.Close()
+	reader := bufio.NewReader(c)
+
+	for {
+		var header [10]byte
+		if _, err := io.ReadFull(reader, header[:6]); err != nil {
+			return
+		}
+		if header[0] != lumberjackVersion || header[1] != lumberjackWindow {
+			t.Errorf("expected a window frame, got % x", header[:6])
+			return
+		}
+
+		window := make([]string, binary.BigEndian.Uint32(header[2:6]))
+		for i := range window {
+			if _, err := io.ReadFull(reader, header[:]); err != nil {
+				t.Error(err)
+				return
+			}
+			if header[0] != lumberjackVersion || header[1] != lumberjackJSON || binary.BigEndian.Uint32(header[2:6]) != uint32(i+1) {
+				t.Errorf("frame %d of the window has header % x", i+1, header)
+			}
+			event := make([]byte, binary.BigEndian.Uint32(header[6:10]))
+			if _, err := io.ReadFull(reader, event); err != nil {
+				t.Error(err)
+				return
+			}
+			window[i] = string(event)
+		}
+
+		s.mu.Lock()
+		s.windows = append(s.windows, window)
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+
+		seqs := acks(conn, window)
+		for _, seq := range seqs {
+			ack := [6]byte{lumberjackVersion, lumberjackAck}
+			binary.BigEndian.PutUint32(ack[2:], seq)
+			c.Write(ack[:])
+		}
+		if len(seqs) == 0 || seqs[len(seqs)-1] != uint32(len(window)) {
+			return
+		}
+	}
+}
+
+// received returns the windows received and the connections they arrived
+// on.
+func (s *beatsServer) received() ([][]string, []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.windows, s.conns
+}
+
+func dialAck(t *testing.T, address string, options map[string]string) *ackConn {
+	options["ack_flush_interval"] = "1h"
+	conn, err := (&ackTransport{}).Dial(address, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.(*ackConn)
+}
+
+func TestAckRoundTrip(t *testing.T) {
+	server := newBeatsServer(t, func(conn int, window []string) []uint32 {
+		// A keepalive, then the window in two steps.
+		return []uint32{0, 1, uint32(len(window))}
+	})
+	defer server.Close()
+
+	conn := dialAck(t, server.Addr().String(), map[string]string{"ack_window": "3"})
+	var events []string
+	for i := 0; i < 7; i++ {
+		event := `{"message":"` + strings.Repeat("x", i*100) + `"}`
+		if _, err := conn.Write([]byte(event)); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	windows, conns := server.received()
+	if len(windows) != 3 || len(windows[0]) != 3 || len(windows[1]) != 3 || len(windows[2]) != 1 {
+		t.Fatalf("received windows %v, want 3, 3 and 1 events", windows)
+	}
+	var got []string
+	for i, window := range windows {
+		got = append(got, window...)
+		if conns[i] != 1 {
+			t.Errorf("window %d sent on connection %d, want all on the first", i, conns[i])
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(events, "\n") {
+		t.Errorf("received %q, want %q", got, events)
+	}
+}
+
+// TestAckResend checks that only the events a lost connection didn't
+// acknowledge are resent on the next one.
+func TestAckResend(t *testing.T) {
+	server := newBeatsServer(t, func(conn int, window []string) []uint32 {
+		if conn == 1 {
+			return []uint32{2}
+		}
+		return []uint32{uint32(len(window))}
+	})
+	defer server.Close()
+
+	transport := &ackTransport{}
+	options := map[string]string{"ack_window": "3", "ack_flush_interval": "1h"}
+	conn, err := transport.Dial(server.Addr().String(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range []string{"one", "two", "three"} {
+		if _, err := conn.Write([]byte(event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pending := conn.(*ackConn).pending; len(pending) != 1 || string(pending[0]) != "three" {
+		t.Errorf("left %q queued, want the unacknowledged event", pending)
+	}
+	conn.Close()
+
+	conn, err = transport.Dial(server.Addr().String(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	windows, conns := server.received()
+	if len(windows) != 2 || conns[1] != 2 || strings.Join(windows[1], ",") != "three" {
+		t.Errorf("received windows %q on connections %v, want the last event resent on a new connection", windows, conns)
+	}
+}
+
+// TestAckTimeout checks that a server that stops acknowledging fails the
+// window after ack_timeout, keeping its events queued.
+func TestAckTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := newBeatsServer(t, func(conn int, window []string) []uint32 {
+		<-release
+		return nil
+	})
+	defer server.Close()
+	defer close(release)
+
+	conn := dialAck(t, server.Addr().String(), map[string]string{"ack_window": "2", "ack_timeout": "50ms"})
+	defer conn.Close()
+	conn.Write([]byte("one"))
+
+	start := time.Now()
+	conn.Write([]byte("two"))
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("window failed after %v, want ack_timeout", elapsed)
+	}
+	if len(conn.pending) != 2 {
+		t.Errorf("%d events queued, want 2", len(conn.pending))
+	}
+
+	// The queue is full, so the next event is refused.
+	if _, err := conn.Write([]byte("three")); err == nil {
+		t.Error("event queued beyond a full window")
+	}
+}
+
+// TestAckResendAfterTimeout checks that a window the server stopped
+// acknowledging is resent on the connection the sender replaces it with,
+// once the server is back.
+func TestAckResendAfterTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := newBeatsServer(t, func(conn int, window []string) []uint32 {
+		if conn == 1 {
+			<-release
+			return nil
+		}
+		return []uint32{uint32(len(window))}
+	})
+	defer server.Close()
+
+	transport := &ackTransport{}
+	options := map[string]string{"ack_window": "2", "ack_timeout": "50ms", "ack_flush_interval": "1h"}
+	conn, err := transport.Dial(server.Addr().String(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Adapter{
+		conns:         []net.Conn{conn},
+		transport:     transport,
+		address:       server.Addr().String(),
+		options:       options,
+		backoff:       &backoff{initial: time.Millisecond, max: time.Millisecond, multiplier: 1},
+		retryAttempts: 1,
+		redialAfter:   defaultRedialAfter,
+	}
+	s := &sender{adapter: a}
+
+	// The window times out, and the event after it is refused, so the
+	// sender replaces the connection.
+	for _, event := range []string{"one", "two", "three"} {
+		s.write([]byte(event))
+	}
+	if a.conns[0] == conn || a.conns[0] == nil {
+		t.Fatal("connection not replaced after the ack timeout")
+	}
+	close(release)
+
+	s.write([]byte("four"))
+	if err := a.conns[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	windows, conns := server.received()
+	var last []string
+	for i, window := range windows {
+		if conns[i] == conns[len(conns)-1] {
+			last = append(last, strings.Join(window, ","))
+		}
+	}
+	if strings.Join(last, "|") != "one,two|four" {
+		t.Errorf("the last connection received %q, want the unacknowledged window resent", last)
+	}
+	if a.counters.failed != 1 {
+		t.Errorf("failed = %d, want the refused event", a.counters.failed)
+	}
+}
@@ -0,0 +1,67 @@
+package logstash
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultBackoffInitial    = time.Second
+	defaultBackoffMax        = 30 * time.Second
+	defaultBackoffMultiplier = 2
+)
+
+// backoff computes the delays between reconnects and retries: the initial
+// delay grows by the multiplier after every failure, up to the maximum.
+// With jitter, each delay is picked at random from its upper half, so
+// adapters that lost the same server don't reconnect in lockstep.
+type backoff struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+	jitter     bool
+}
+
+// newBackoff builds a backoff from the route options.
+func newBackoff(options map[string]string) (*backoff, error) {
+	b := new(backoff)
+
+	var err error
+	if b.initial, err = durationOption(options, "backoff_initial", defaultBackoffInitial); err != nil {
+		return nil, err
+	}
+	if b.max, err = durationOption(options, "backoff_max", defaultBackoffMax); err != nil {
+		return nil, err
+	}
+	if b.multiplier, err = floatOption(options, "backoff_multiplier", defaultBackoffMultiplier, 1); err != nil {
+		return nil, err
+	}
+	if b.jitter, err = boolOption(options, "backoff_jitter", true); err != nil {
+		return nil, err
+	}
+
+	if b.max < b.initial {
+		return nil, errors.New("logstash: invalid backoff_max: must not be less than backoff_initial")
+	}
+
+	return b, nil
+}
+
+// delay returns the delay after the given number of consecutive failures,
+// starting at 1.
+func (b *backoff) delay(failures int) time.Duration {
+	d := float64(b.initial)
+	for i := 1; i < failures && d < float64(b.max); i++ {
+		d *= b.multiplier
+	}
+	if d > float64(b.max) {
+		d = float64(b.max)
+	}
+
+	if b.jitter {
+		d = d/2 + rand.Float64()*d/2
+	}
+
+	return time.Duration(d)
+}
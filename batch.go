@@ -0,0 +1,174 @@
+package logstash
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// batchConn collects the events written to it and hands them to send in
+// batches, for outputs that take many events per request. Each Write must
+// hold exactly one event.
+//
+// A batch is taken out before it is sent, so events can be added while a
+// slow endpoint is retried. Batches are sent one at a time, in order.
+// Batches that can't be sent are only logged unless a failure handler is
+// set.
+type batchConn struct {
+	name          string
+	batchSize     int
+	flushInterval time.Duration
+	send          func(batch [][]byte) ([][]byte, error)
+
+	// probe, if set, verifies the endpoint for the startup check.
+	probe func() error
+
+	// sendMu is held while a batch is sent, and guards failed.
+	sendMu sync.Mutex
+	failed func(batch [][]byte, err error)
+
+	mu     sync.Mutex
+	batch  [][]byte
+	done   chan struct{}
+	closed bool
+}
+
+// newBatchConn starts a batchConn. name prefixes its log messages. send
+// returns the events of the batch it couldn't deliver, with the error that
+// explains why.
+func newBatchConn(name string, batchSize int, flushInterval time.Duration, send func([][]byte) ([][]byte, error)) *batchConn {
+	c := &batchConn{
+		name:          name,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		send:          send,
+		done:          make(chan struct{}),
+	}
+
+	go c.flushLoop()
+
+	return c
+}
+
+// setFailureHandler sets the function given the events of a batch that
+// couldn't be delivered.
+func (c *batchConn) setFailureHandler(failed func(batch [][]byte, err error)) {
+	c.sendMu.Lock()
+	c.failed = failed
+	c.sendMu.Unlock()
+}
+
+// Write implements net.Conn. When the batch fills it is sent before Write
+// returns, so a slow endpoint slows down the sender. Failed batches are
+// handed to the failure handler rather than failing the write, as they hold
+// more events than this one.
+func (c *batchConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, errors.New(c.name + ": use of closed connection")
+	}
+
+	// The caller reuses p once Write returns.
+	c.batch = append(c.batch, append([]byte(nil), p...))
+	full := len(c.batch) >= c.batchSize
+	c.mu.Unlock()
+
+	if full {
+		c.flush()
+	}
+
+	return len(p), nil
+}
+
+// flushLoop sends partial batches every flushInterval.
+func (c *batchConn) flushLoop() {
+	ticker := time.NewTicker(c.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.flush()
+	}
+}
+
+// flush takes the batch out and sends it, handing the events that weren't
+// delivered to the failure handler.
+func (c *batchConn) flush() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	c.mu.Lock()
+	batch := c.batch
+	c.batch = nil
+	c.mu.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+	if failed, err := c.send(batch); err != nil {
+		logError(c.name+":", err)
+		if c.failed != nil && len(failed) > 0 {
+			c.failed(failed, err)
+		}
+	}
+}
+
+// check implements checker.
+func (c *batchConn) check() error {
+	if c.probe == nil {
+		return nil
+	}
+	return c.probe()
+}
+
+// Read is not supported; the adapter only writes.
+func (c *batchConn) Read(p []byte) (int, error) {
+	return 0, errors.New(c.name + ": read not supported")
+}
+
+// Close sends any buffered events and stops the flush loop.
+func (c *batchConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	c.mu.Unlock()
+
+	c.flush()
+	return nil
+}
+
+// LocalAddr implements net.Conn.
+func (c *batchConn) LocalAddr() net.Addr {
+	return nil
+}
+
+// RemoteAddr implements net.Conn.
+func (c *batchConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+// SetDeadline implements net.Conn.
+func (c *batchConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *batchConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *batchConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,79 @@
+package logstash
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultMultilineMaxBuffer is the default ceiling on the bytes held by all
+// multiline buffers together.
+const defaultMultilineMaxBuffer = 64 << 20
+
+// bufferBudget enforces a ceiling on the bytes held by the multiline
+// buffers of all container streams. When the ceiling is exceeded, the
+// largest buffers are asked to flush until the total fits again.
+type bufferBudget struct {
+	limit    int
+	counters *counters
+
+	mu    sync.Mutex
+	total int
+	sizes map[*aggregator]int
+}
+
+// newBufferBudget creates a budget of limit bytes.
+func newBufferBudget(limit int, counters *counters) *bufferBudget {
+	return &bufferBudget{
+		limit:    limit,
+		counters: counters,
+		sizes:    make(map[*aggregator]int),
+	}
+}
+
+// update records the bytes buffered by g and requests flushes if the
+// ceiling is exceeded.
+func (b *bufferBudget) update(g *aggregator, size int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delta := size - b.sizes[g]
+	b.total += delta
+	atomic.AddInt64(&b.counters.bufferedBytes, int64(delta))
+
+	if size == 0 {
+		delete(b.sizes, g)
+	} else {
+		b.sizes[g] = size
+	}
+
+	if b.total <= b.limit {
+		return
+	}
+
+	largest := make([]*aggregator, 0, len(b.sizes))
+	for buffer := range b.sizes {
+		largest = append(largest, buffer)
+	}
+	sort.Slice(largest, func(i, j int) bool {
+		return b.sizes[largest[i]] > b.sizes[largest[j]]
+	})
+
+	// Flushes happen in the aggregators' own goroutines, so the total only
+	// drops once they get to them.
+	remaining := b.total
+	flushed := 0
+	for _, buffer := range largest {
+		if remaining <= b.limit {
+			break
+		}
+		select {
+		case buffer.flushNow <- struct{}{}:
+		default:
+		}
+		remaining -= b.sizes[buffer]
+		flushed++
+	}
+
+	logWarn("logstash_multiline: buffers hold", b.total, "bytes, over the limit of", b.limit, "- flushing", flushed, "of them")
+}
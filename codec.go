@@ -0,0 +1,242 @@
+package logstash
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Codecs selectable with the codec option.
+const (
+	codecJSON   = "json"
+	codecSyslog = "syslog"
+)
+
+// codec encodes an event into a buffer ready to be written.
+type codec interface {
+	encode(buf *encodeBuffer, m *Message) error
+}
+
+// newCodec builds the codec selected by the route options.
+func newCodec(options map[string]string, schema *schema) (codec, error) {
+	name, err := enumOption(options, "codec", codecJSON, codecJSON, codecSyslog)
+	if err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case codecSyslog:
+		if schema != nil {
+			return nil, errors.New("logstash: rename, omit, nest_docker, envelope and timestamp_layouts are only supported by the json codec")
+		}
+
+		sdID := options["syslog_sd_id"]
+		if sdID == "" {
+			sdID = defaultSDID
+		}
+		if !validSyslogName(sdID, 32) {
+			return nil, errors.New("logstash: invalid syslog_sd_id: " + sdID)
+		}
+
+		return &syslogCodec{sdID: sdID}, nil
+	default:
+		return &jsonCodec{schema: schema}, nil
+	}
+}
+
+// jsonCodec encodes events as a single JSON object.
+type jsonCodec struct {
+	schema *schema
+}
+
+func (c *jsonCodec) encode(buf *encodeBuffer, m *Message) error {
+	var err error
+	if c.schema == nil {
+		err = buf.encoder.Encode(m)
+	} else {
+		err = buf.encoder.Encode(c.schema.apply(m))
+	}
+	if err != nil {
+		return err
+	}
+
+	// Drop the newline added by the encoder.
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
+
+// defaultSDID is the structured data ID carrying the container metadata.
+// 32473 is the private enterprise number reserved for documentation.
+const defaultSDID = "docker@32473"
+
+// syslogCodec encodes events as RFC 5424 syslog messages, with the container
+// metadata carried as structured data.
+//
+// Merged events span several lines, so over stream connections messages are
+// framed by octet counting as described in RFC 6587, and in files their
+// newlines are escaped as #012, as rsyslog does.
+type syslogCodec struct {
+	sdID           string
+	octetCounting  bool
+	escapeNewlines bool
+}
+
+// Syslog severities for the user-level facility.
+const (
+	syslogUserInfo  = 1*8 + 6
+	syslogUserError = 1*8 + 3
+)
+
+// syslogLevels maps the level field to severities of the user-level facility.
+var syslogLevels = map[string]int{
+	"trace":  1*8 + 7,
+	"debug":  1*8 + 7,
+	"info":   1*8 + 6,
+	"notice": 1*8 + 5,
+	"warn":   1*8 + 4,
+	"error":  1*8 + 3,
+	"fatal":  1*8 + 2,
+}
+
+func (c *syslogCodec) encode(buf *encodeBuffer, m *Message) error {
+	start := buf.Len()
+
+	priority := syslogUserInfo
+	if m.Stream == "stderr" {
+		priority = syslogUserError
+	}
+	if level, found := syslogLevels[m.Fields["level"]]; found {
+		priority = level
+	}
+
+	timestamp := "-"
+	if t := m.EventTime(); !t.IsZero() {
+		timestamp = t.UTC().Format("2006-01-02T15:04:05.000000Z07:00")
+	}
+
+	buf.WriteByte('<')
+	buf.WriteString(strconv.Itoa(priority))
+	buf.WriteString(">1 ")
+	buf.WriteString(timestamp)
+	buf.WriteByte(' ')
+	buf.WriteString(syslogHeader(m.Host, 255))
+	buf.WriteByte(' ')
+	buf.WriteString(syslogHeader(m.Name, 48))
+	buf.WriteString(" - - [")
+	buf.WriteString(c.sdID)
+
+	c.writeParam(buf, "name", m.Name)
+	c.writeParam(buf, "id", m.ID)
+	c.writeParam(buf, "image", m.Image)
+	c.writeParam(buf, "hostname", m.Hostname)
+	c.writeParam(buf, "stream", m.Stream)
+	for _, tag := range m.Tags {
+		c.writeParam(buf, "tag", tag)
+	}
+	if m.Environment != "" {
+		c.writeParam(buf, "environment", m.Environment)
+	}
+	if m.Type != "" {
+		c.writeParam(buf, "type", m.Type)
+	}
+	if m.Sequence != 0 {
+		c.writeParam(buf, "sequence", strconv.FormatUint(m.Sequence, 10))
+	}
+	if m.Fingerprint != "" {
+		c.writeParam(buf, "fingerprint", m.Fingerprint)
+	}
+
+	keys := make([]string, 0, len(m.Fields))
+	for key := range m.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if validSyslogName(key, 32) {
+			c.writeParam(buf, key, m.Fields[key])
+		}
+	}
+
+	buf.WriteString("] ")
+	c.writeText(buf, m.Message)
+
+	if c.octetCounting {
+		prefixFrame(buf, start)
+	}
+	return nil
+}
+
+// writeParam appends a structured data parameter, escaping the value as
+// required by RFC 5424 section 6.3.3.
+func (c *syslogCodec) writeParam(buf *encodeBuffer, name, value string) {
+	buf.WriteByte(' ')
+	buf.WriteString(name)
+	buf.WriteString(`="`)
+	for _, r := range value {
+		switch r {
+		case '"', '\\', ']':
+			buf.WriteByte('\\')
+		case '\n':
+			if c.escapeNewlines {
+				buf.WriteString("#012")
+				continue
+			}
+		}
+		buf.WriteRune(r)
+	}
+	buf.WriteByte('"')
+}
+
+// writeText appends the message, escaping its newlines if required.
+func (c *syslogCodec) writeText(buf *encodeBuffer, text string) {
+	if c.escapeNewlines {
+		text = strings.Replace(text, "\n", "#012", -1)
+	}
+	buf.WriteString(text)
+}
+
+// prefixFrame inserts the octet count of the message that starts at start,
+// followed by a space.
+func prefixFrame(buf *encodeBuffer, start int) {
+	prefix := strconv.Itoa(buf.Len()-start) + " "
+	buf.WriteString(prefix)
+
+	frame := buf.Bytes()[start:]
+	copy(frame[len(prefix):], frame[:len(frame)-len(prefix)])
+	copy(frame, prefix)
+}
+
+// syslogHeader makes value safe for a header field: printable ASCII without
+// spaces, at most max bytes, or the nil value "-".
+func syslogHeader(value string, max int) string {
+	value = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, value)
+
+	if len(value) > max {
+		value = value[:max]
+	}
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// validSyslogName reports whether value is a valid SD-NAME.
+func validSyslogName(value string, max int) bool {
+	if value == "" || len(value) > max {
+		return false
+	}
+
+	for _, r := range value {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return false
+		}
+	}
+
+	return true
+}
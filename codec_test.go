@@ -0,0 +1,112 @@
+package logstash
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func encodeSyslog(t *testing.T, c *syslogCodec, m *Message) string {
+	buf := bufferPool.Get().(*encodeBuffer)
+	defer buf.release()
+
+	if err := c.encode(buf, m); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestSyslogCodecRoundTrip(t *testing.T) {
+	m := &Message{
+		Message:     "disk full",
+		Name:        "web",
+		ID:          "abc123",
+		Image:       "nginx",
+		Hostname:    "abc123",
+		Host:        "docker-1",
+		Stream:      "stderr",
+		Tags:        []string{"a"},
+		Sequence:    7,
+		Fingerprint: "f00d",
+		Fields:      map[string]string{"level": "warn", "quote": `say "hi"]`},
+		Timestamp:   time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	line := encodeSyslog(t, &syslogCodec{sdID: defaultSDID}, m)
+
+	parsed, ok := parseSyslog(line)
+	if !ok {
+		t.Fatalf("parseSyslog(%q) failed", line)
+	}
+	if parsed.priority != syslogLevels["warn"] {
+		t.Errorf("priority = %d, want %d", parsed.priority, syslogLevels["warn"])
+	}
+	if parsed.timestamp != "2024-05-01T12:00:00.000000Z" {
+		t.Errorf("timestamp = %q", parsed.timestamp)
+	}
+	if parsed.hostname != "docker-1" || parsed.program != "web" {
+		t.Errorf("hostname, program = %q, %q", parsed.hostname, parsed.program)
+	}
+	if parsed.message != "disk full" {
+		t.Errorf("message = %q, want %q", parsed.message, "disk full")
+	}
+
+	for _, param := range []string{
+		`sequence="7"`,
+		`fingerprint="f00d"`,
+		`level="warn"`,
+		`quote="say \"hi\"\]"`,
+		`tag="a"`,
+	} {
+		if !strings.Contains(line, param) {
+			t.Errorf("%q is missing %s", line, param)
+		}
+	}
+}
+
+func TestSyslogCodecOctetCounting(t *testing.T) {
+	m := &Message{
+		Message:   "Traceback (most recent call last):\n  File \"x.py\", line 1, in <module>",
+		Name:      "web",
+		Stream:    "stdout",
+		Timestamp: time.Now(),
+	}
+
+	frame := encodeSyslog(t, &syslogCodec{sdID: defaultSDID, octetCounting: true}, m)
+
+	space := strings.IndexByte(frame, ' ')
+	if space < 1 {
+		t.Fatalf("frame %q has no octet count", frame)
+	}
+	length, err := strconv.Atoi(frame[:space])
+	if err != nil {
+		t.Fatalf("frame %q: %v", frame, err)
+	}
+	text := frame[space+1:]
+	if length != len(text) {
+		t.Fatalf("octet count is %d, message is %d bytes", length, len(text))
+	}
+
+	parsed, ok := parseSyslog(text)
+	if !ok || parsed.message != m.Message {
+		t.Errorf("parsed message = %q, want %q", parsed.message, m.Message)
+	}
+}
+
+func TestSyslogCodecEscapeNewlines(t *testing.T) {
+	m := &Message{
+		Message:   "first\nsecond",
+		Stream:    "stdout",
+		Fields:    map[string]string{"note": "a\nb"},
+		Timestamp: time.Now(),
+	}
+
+	line := encodeSyslog(t, &syslogCodec{sdID: defaultSDID, escapeNewlines: true}, m)
+	if strings.Contains(line, "\n") {
+		t.Fatalf("%q contains a newline", line)
+	}
+	if !strings.HasSuffix(line, "] first#012second") || !strings.Contains(line, `note="a#012b"`) {
+		t.Errorf("newlines not escaped in %q", line)
+	}
+}
@@ -0,0 +1,304 @@
+package logstash
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"text/template"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configEnv names the environment variable holding the config file path.
+const configEnv = "LOGSTASH_CONFIG"
+
+// environmentEnv names the environment variable holding the deployment
+// environment, used when the route has no environment option.
+const environmentEnv = "LOGSTASH_ENV"
+
+// reservedFields are the keys written by the adapter itself, which static
+// fields may not overwrite.
+var reservedFields = map[string]bool{
+	"message":            true,
+	"container_name":     true,
+	"container_id":       true,
+	"image_name":         true,
+	"container_hostname": true,
+	"host":               true,
+	"stream":             true,
+	"tags":               true,
+	"environment":        true,
+	"docker":             true,
+	"type":               true,
+	"sequence":           true,
+	"lines":              true,
+	"line_count":         true,
+	"fingerprint":        true,
+	"@timestamp":         true,
+	"@version":           true,
+	"docker_timestamp":   true,
+}
+
+// Config is the optional YAML configuration file for the adapter.
+type Config struct {
+	// Address is used when the route does not specify one.
+	Address string `yaml:"address"`
+
+	// Options are defaults for route options; the route's own options win.
+	Options map[string]string `yaml:"options"`
+
+	// Fields are static fields added to every event.
+	Fields map[string]string `yaml:"fields"`
+
+	// Rename maps output field names to the names used instead, e.g.
+	// message: log. The route's rename option takes precedence.
+	Rename map[string]string `yaml:"rename"`
+
+	// Templates are Go text/templates rendered against each event, keyed by
+	// the field they set. A "message" template replaces the message.
+	Templates map[string]string `yaml:"templates"`
+
+	Multiline struct {
+		// Patterns replace the built-in continuation regexps.
+		Patterns []string `yaml:"patterns"`
+
+		// Pattern, Negate and Match use Filebeat's semantics instead: lines
+		// matching Pattern (or not matching it, with Negate) are joined to
+		// the line before them (Match "after") or after them ("before").
+		Pattern string `yaml:"pattern"`
+		Negate  bool   `yaml:"negate"`
+		Match   string `yaml:"match"`
+
+		// Timeout flushes a pending Pattern event after this long without
+		// new lines.
+		Timeout string `yaml:"timeout"`
+	} `yaml:"multiline"`
+
+	// Parse are regexps with named captures, such as
+	// (?P<method>[A-Z]+) (?P<path>\S+). The captures of the first one that
+	// matches an event become its fields.
+	Parse []string `yaml:"parse"`
+
+	Filters struct {
+		// Include, when set, only ships lines matching one of the regexps.
+		Include []string `yaml:"include"`
+		// Exclude drops lines matching any of the regexps.
+		Exclude []string `yaml:"exclude"`
+	} `yaml:"filters"`
+}
+
+// LoadConfig reads and validates a config file. Unknown keys are rejected.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(Config)
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("logstash_config: %s: %v", path, err)
+	}
+
+	if err := config.overrideOptions(config.Options); err != nil {
+		return nil, fmt.Errorf("logstash_config: %s: %v", path, err)
+	}
+
+	if _, err := config.compile(); err != nil {
+		return nil, fmt.Errorf("logstash_config: %s: %v", path, err)
+	}
+
+	return config, nil
+}
+
+// loadConfigFromEnv loads the config file named by LOGSTASH_CONFIG, if any.
+func loadConfigFromEnv() (*Config, error) {
+	path := os.Getenv(configEnv)
+	if path == "" {
+		return new(Config), nil
+	}
+
+	return LoadConfig(path)
+}
+
+// overrideOptions applies route options that have config file equivalents.
+func (c *Config) overrideOptions(options map[string]string) error {
+	if value := options["multiline_pattern"]; value != "" {
+		c.Multiline.Pattern = value
+	}
+	if value := options["multiline_match"]; value != "" {
+		c.Multiline.Match = value
+	}
+	if value := options["multiline_timeout"]; value != "" {
+		c.Multiline.Timeout = value
+	}
+
+	if _, found := options["multiline_negate"]; found {
+		negate, err := boolOption(options, "multiline_negate", false)
+		if err != nil {
+			return err
+		}
+		c.Multiline.Negate = negate
+	}
+
+	return nil
+}
+
+// multilineRule is a compiled Filebeat-style multiline configuration.
+type multilineRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	before  bool
+	timeout time.Duration
+}
+
+// continues reports whether a line belongs to a neighbouring event.
+func (r *multilineRule) continues(message string) bool {
+	return r.pattern.MatchString(message) != r.negate
+}
+
+// compileMultilineRule compiles the Pattern, Negate and Match settings.
+func (c *Config) compileMultilineRule() (*multilineRule, error) {
+	m := c.Multiline
+	if m.Pattern == "" {
+		if m.Match != "" || m.Negate || m.Timeout != "" {
+			return nil, errors.New("multiline: match, negate and timeout require a pattern")
+		}
+		return nil, nil
+	}
+
+	if len(m.Patterns) > 0 {
+		return nil, errors.New("multiline: pattern and patterns cannot be combined")
+	}
+
+	pattern, err := regexp.Compile(m.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("multiline.pattern: %v", err)
+	}
+
+	rule := &multilineRule{
+		pattern: pattern,
+		negate:  m.Negate,
+		timeout: defaultMultilineTimeout,
+	}
+
+	switch m.Match {
+	case "", "after":
+	case "before":
+		rule.before = true
+	default:
+		return nil, fmt.Errorf("multiline.match: %q must be after or before", m.Match)
+	}
+
+	if m.Timeout != "" {
+		if rule.timeout, err = time.ParseDuration(m.Timeout); err != nil || rule.timeout <= 0 {
+			return nil, fmt.Errorf("multiline.timeout: %q must be a positive duration", m.Timeout)
+		}
+	}
+
+	return rule, nil
+}
+
+// defaultMultilineTimeout flushes pattern-based events after a quiet period.
+const defaultMultilineTimeout = 5 * time.Second
+
+// rules are the compiled per-event parts of the configuration.
+type rules struct {
+	multiline      []*regexp.Regexp
+	multilineRule  *multilineRule
+	include        []*regexp.Regexp
+	exclude        []*regexp.Regexp
+	parse          []*regexp.Regexp
+	fields         map[string]string
+	templates      map[string]*template.Template
+	templateFields []string
+}
+
+// compile validates the config and compiles its per-event rules.
+func (c *Config) compile() (*rules, error) {
+	r := &rules{
+		fields: c.Fields,
+	}
+
+	for key := range c.Fields {
+		if key == "" || reservedFields[key] {
+			return nil, errors.New("invalid field name: " + key)
+		}
+	}
+
+	var err error
+	if r.templates, r.templateFields, err = compileTemplates(c.Templates); err != nil {
+		return nil, err
+	}
+	if r.multiline, err = compilePatterns("multiline.patterns", c.Multiline.Patterns); err != nil {
+		return nil, err
+	}
+	if r.multilineRule, err = c.compileMultilineRule(); err != nil {
+		return nil, err
+	}
+	if r.include, err = compilePatterns("filters.include", c.Filters.Include); err != nil {
+		return nil, err
+	}
+	if r.exclude, err = compilePatterns("filters.exclude", c.Filters.Exclude); err != nil {
+		return nil, err
+	}
+	if r.parse, err = compileParsePatterns(c.Parse); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// compilePatterns compiles a list of regexps, naming the offending key on error.
+func compilePatterns(key string, patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+
+	for _, pattern := range patterns {
+		expression, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		compiled = append(compiled, expression)
+	}
+
+	return compiled, nil
+}
+
+// isMultiline reports whether a line continues the previous message, using
+// the configured patterns or the built-in ones.
+func (r *rules) isMultiline(message string) bool {
+	if r.multiline == nil {
+		return IsMultiline(message)
+	}
+
+	for _, expression := range r.multiline {
+		if expression.MatchString(message) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// accept reports whether a line passes the include and exclude filters.
+func (r *rules) accept(message string) bool {
+	for _, expression := range r.exclude {
+		if expression.MatchString(message) {
+			return false
+		}
+	}
+
+	if len(r.include) == 0 {
+		return true
+	}
+
+	for _, expression := range r.include {
+		if expression.MatchString(message) {
+			return true
+		}
+	}
+
+	return false
+}
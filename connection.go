@@ -0,0 +1,218 @@
+package logstash
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRedialAfter is the number of consecutive write errors after which
+// a connection is re-created.
+const defaultRedialAfter = 3
+
+// dial opens a new connection to the Logstash server. The transport
+// resolves the address again, so DNS changes are picked up.
+func (a *Adapter) dial() (net.Conn, error) {
+	conn, err := a.transport.Dial(a.address, a.options)
+	if err != nil {
+		return nil, err
+	}
+
+	// logspout's own tcp and tls transports don't enable keepalives.
+	if err := setKeepAlive(conn, a.keepAlive); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if a.sendBuffer > 0 {
+		if err := setSendBuffer(conn, a.sendBuffer); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if batcher, ok := conn.(*batchConn); ok {
+		batcher.setFailureHandler(a.batchFailed)
+	}
+
+	logDebug("logstash: connected to", a.address)
+	return conn, nil
+}
+
+// batchFailed dead-letters the events of a batch that a batching output
+// couldn't send.
+func (a *Adapter) batchFailed(batch [][]byte, err error) {
+	atomic.AddUint64(&a.counters.failed, uint64(len(batch)))
+	for _, event := range batch {
+		a.deadLetter.write(deadLetterWrite, err, nil, event)
+	}
+}
+
+// errConnectionDown is recorded for events dropped while a connection is
+// being re-dialed.
+var errConnectionDown = errors.New("connection down")
+
+// sender writes to one of the adapter's connections, re-dialing it after
+// repeated write errors. Connected UDP sockets, for example, keep returning
+// ECONNREFUSED after Logstash restarts on some platforms.
+//
+// With a spool, events that can't be written are spooled instead of
+// dropped, and new events queue behind them until the spool is replayed.
+type sender struct {
+	adapter      *Adapter
+	shard        int
+	spool        *spool
+	pending      <-chan net.Conn
+	failures     int
+	dialFailures int
+	nextDial     time.Time
+}
+
+// write sends p, making up to retry_attempts attempts before spooling it,
+// or logging and dropping it without a spool.
+func (s *sender) write(p []byte) {
+	a := s.adapter
+
+	if s.spool != nil && !s.spool.empty() {
+		s.spoolEvent(p)
+		s.replay()
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		reason, err := deadLetterNoServer, errConnectionDown
+		if a.conns[s.shard] != nil || s.redial() {
+			if err = s.send(p); err == nil {
+				return
+			}
+			reason = deadLetterWrite
+		}
+
+		if attempt >= a.retryAttempts {
+			if s.spool != nil {
+				s.spoolEvent(p)
+				return
+			}
+			atomic.AddUint64(&a.counters.failed, 1)
+			a.deadLetter.write(reason, err, nil, p)
+			return
+		}
+
+		// Wait for the next redial while the connection is down. Pending
+		// connections are dialed in the background with no redial time.
+		wait := a.backoff.delay(attempt)
+		if until := time.Until(s.nextDial); a.conns[s.shard] == nil && s.pending == nil && until > 0 {
+			wait = until
+		}
+		time.Sleep(wait)
+	}
+}
+
+// send writes p to the connection, re-dialing after repeated errors.
+func (s *sender) send(p []byte) error {
+	a := s.adapter
+
+	conn := a.conns[s.shard]
+	if a.writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(a.writeTimeout))
+	}
+
+	_, err := conn.Write(p)
+	if a.writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Time{})
+	}
+
+	if err != nil {
+		logError("logstash_write:", err)
+
+		// A timed out write may have been sent in part, which would corrupt
+		// the stream, so the connection is replaced right away.
+		s.failures++
+		if s.failures >= a.redialAfter || isTimeout(err) {
+			a.conns[s.shard].Close()
+			a.conns[s.shard] = nil
+			s.redial()
+		}
+		return err
+	}
+
+	s.failures = 0
+	atomic.AddUint64(&a.counters.sent, 1)
+	atomic.AddUint64(&a.counters.bytes, uint64(len(p)))
+	return nil
+}
+
+// isTimeout reports whether a write failed because its deadline passed.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// spoolEvent adds p to the spool, dead-lettering it if the spool fails.
+func (s *sender) spoolEvent(p []byte) {
+	if err := s.spool.append(p); err != nil {
+		logError("logstash_spool:", err)
+		atomic.AddUint64(&s.adapter.counters.failed, 1)
+		s.adapter.deadLetter.write(deadLetterWrite, err, nil, p)
+	}
+}
+
+// replay sends the spooled events once the connection is back.
+func (s *sender) replay() {
+	a := s.adapter
+
+	if a.conns[s.shard] == nil && !s.redial() {
+		return
+	}
+
+	err := s.spool.replay(func(p []byte) error {
+		if a.conns[s.shard] == nil {
+			return errConnectionDown
+		}
+		return s.send(p)
+	})
+	if err == nil {
+		logInfo("logstash_spool: replay complete")
+	}
+}
+
+// redial replaces the connection. Redials are spaced by backoff_initial,
+// and the delay grows with each failed redial.
+func (s *sender) redial() bool {
+	a := s.adapter
+
+	// A connection that failed its startup check is dialed in the
+	// background instead.
+	if s.pending != nil {
+		select {
+		case conn := <-s.pending:
+			s.pending = nil
+			a.conns[s.shard] = conn
+			return true
+		default:
+			return false
+		}
+	}
+
+	if time.Now().Before(s.nextDial) {
+		return false
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		s.dialFailures++
+		s.nextDial = time.Now().Add(a.backoff.delay(s.dialFailures))
+		logWarn("logstash_redial:", err)
+		return false
+	}
+
+	s.dialFailures = 0
+	s.nextDial = time.Now().Add(a.backoff.initial)
+
+	logInfo("logstash: reconnected to", a.address)
+	atomic.AddUint64(&a.counters.reconnects, 1)
+	a.conns[s.shard] = conn
+	s.failures = 0
+	return true
+}
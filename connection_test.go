@@ -0,0 +1,66 @@
+package logstash
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestSenderPendingWaits checks that events for a connection still being
+// dialed in the background wait between attempts instead of spinning.
+func TestSenderPendingWaits(t *testing.T) {
+	a := &Adapter{
+		conns:         []net.Conn{nil},
+		backoff:       &backoff{initial: 20 * time.Millisecond, max: 20 * time.Millisecond, multiplier: 1},
+		retryAttempts: 3,
+		redialAfter:   defaultRedialAfter,
+	}
+	s := &sender{adapter: a, pending: make(chan net.Conn)}
+
+	start := time.Now()
+	s.write([]byte("event"))
+
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("gave up after %v, want two backoff delays", elapsed)
+	}
+	if a.counters.failed != 1 {
+		t.Errorf("failed = %d, want 1", a.counters.failed)
+	}
+}
+
+// TestSenderPendingConnects checks that the event is sent once the
+// background dial hands over the connection.
+func TestSenderPendingConnects(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	pending := make(chan net.Conn, 1)
+	a := &Adapter{
+		conns:         []net.Conn{nil},
+		backoff:       &backoff{initial: 20 * time.Millisecond, max: 20 * time.Millisecond, multiplier: 1},
+		retryAttempts: 3,
+		redialAfter:   defaultRedialAfter,
+	}
+	s := &sender{adapter: a, pending: pending}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pending <- client
+	}()
+
+	received := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := server.Read(buf)
+		received <- string(buf[:n])
+	}()
+
+	s.write([]byte("event"))
+
+	if got := <-received; got != "event" {
+		t.Errorf("received %q, want %q", got, "event")
+	}
+	if a.counters.sent != 1 || s.pending != nil {
+		t.Errorf("sent = %d, pending = %v", a.counters.sent, s.pending)
+	}
+}
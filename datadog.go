@@ -0,0 +1,310 @@
+package logstash
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+const (
+	defaultDDBatchSize = 500
+	defaultDDFlush     = time.Second
+	defaultDDTimeout   = 10 * time.Second
+
+	// ddMaxBatchSize and ddMaxPayload are the intake's limits on the
+	// number of logs and the uncompressed size of one request.
+	ddMaxBatchSize = 1000
+	ddMaxPayload   = 5 << 20
+
+	// ddRetries is how many times a batch is resent after a retryable
+	// response, waiting as set by the backoff options in between.
+	ddRetries = 5
+
+	// ddAPIKeyEnv holds the API key when dd_api_key isn't set.
+	ddAPIKeyEnv = "DD_API_KEY"
+
+	ddPath = "/api/v2/logs"
+)
+
+func init() {
+	router.AdapterTransports.Register(new(ddTransport), "dd")
+}
+
+// ddTransport ships events to the Datadog logs intake over HTTPS. The
+// route's address is the Datadog site, e.g. datadoghq.eu, or the host:port
+// of an intake relay.
+type ddTransport struct{}
+
+// Dial implements the router.AdapterTransport interface.
+func (t *ddTransport) Dial(addr string, options map[string]string) (net.Conn, error) {
+	apiKey := options["dd_api_key"]
+	if apiKey == "" {
+		apiKey = os.Getenv(ddAPIKeyEnv)
+	}
+	if apiKey == "" {
+		return nil, errors.New("logstash: the dd transport requires the dd_api_key option or " + ddAPIKeyEnv)
+	}
+
+	batchSize, err := intOption(options, "dd_batch_size", defaultDDBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	if batchSize > ddMaxBatchSize {
+		return nil, errors.New("logstash: invalid dd_batch_size: must be at most " + strconv.Itoa(ddMaxBatchSize))
+	}
+	flushInterval, err := durationOption(options, "dd_flush_interval", defaultDDFlush)
+	if err != nil {
+		return nil, err
+	}
+	backoff, err := newBackoff(options)
+	if err != nil {
+		return nil, err
+	}
+
+	host := addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		host = "http-intake.logs." + addr
+	}
+
+	client, err := newHTTPClient(host, options, true, defaultDDTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &ddExporter{
+		url:     "https://" + host + ddPath,
+		apiKey:  apiKey,
+		source:  options["dd_source"],
+		tags:    listOption(options, "dd_tags"),
+		backoff: backoff,
+		client:  client,
+	}
+
+	c := newBatchConn("logstash_dd", batchSize, flushInterval, e.export)
+	c.probe = e.check
+	return c, nil
+}
+
+// ddExporter sends batches of events to the Datadog logs intake.
+type ddExporter struct {
+	url     string
+	apiKey  string
+	source  string
+	tags    []string
+	backoff *backoff
+	client  *http.Client
+}
+
+// ddStatuses maps the level field to Datadog statuses.
+var ddStatuses = map[string]string{
+	"trace":  "debug",
+	"debug":  "debug",
+	"info":   "info",
+	"notice": "notice",
+	"warn":   "warning",
+	"error":  "error",
+	"fatal":  "critical",
+}
+
+// ddTagFields are the event fields sent as tags, with their tag names.
+var ddTagFields = []struct{ field, tag string }{
+	{"container_name", "container_name"},
+	{"container_id", "container_id"},
+	{"image_name", "image_name"},
+	{"environment", "env"},
+}
+
+// check sends a HEAD request to the intake.
+func (e *ddExporter) check() error {
+	req, err := http.NewRequest("HEAD", e.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("DD-API-KEY", e.apiKey)
+	return checkHTTP(e.client, req)
+}
+
+// export converts the batch to intake logs and sends them, splitting
+// requests that would exceed the intake's payload limit.
+func (e *ddExporter) export(batch [][]byte) ([][]byte, error) {
+	var logs []json.RawMessage
+	var events [][]byte
+	for _, event := range batch {
+		log, err := e.ddLog(event)
+		if err != nil {
+			logError("logstash_dd: undecodable event:", err)
+			continue
+		}
+		logs = append(logs, log)
+		events = append(events, event)
+	}
+
+	return e.exportLogs(logs, events)
+}
+
+// exportLogs sends logs, converted from events, in as few requests as the
+// payload limit allows, and returns the events that weren't delivered. Once
+// a request fails, the rest aren't sent.
+func (e *ddExporter) exportLogs(logs []json.RawMessage, events [][]byte) ([][]byte, error) {
+	if len(logs) == 0 {
+		return nil, nil
+	}
+
+	body, err := json.Marshal(logs)
+	if err != nil {
+		return events, err
+	}
+
+	if len(body) > ddMaxPayload && len(logs) > 1 {
+		half := len(logs) / 2
+		if failed, err := e.exportLogs(logs[:half], events[:half]); err != nil {
+			return append(failed, events[half:]...), err
+		}
+		return e.exportLogs(logs[half:], events[half:])
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(body)
+	writer.Close()
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if attempt > ddRetries {
+				return events, errors.New("dropped " + strconv.Itoa(len(logs)) + " events after repeated retryable responses")
+			}
+			time.Sleep(e.backoff.delay(attempt))
+		}
+
+		retry, err := e.post(compressed.Bytes())
+		if !retry {
+			if err != nil {
+				return events, err
+			}
+			return nil, nil
+		}
+		if err != nil {
+			logWarn("logstash_dd:", err)
+		}
+	}
+}
+
+// post sends one request, reporting whether it should be retried.
+func (e *ddExporter) post(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("DD-API-KEY", e.apiKey)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted:
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		io.Copy(ioutil.Discard, resp.Body)
+		return true, errors.New("intake request returned " + resp.Status)
+	default:
+		text, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return false, errors.New("intake request failed: " + resp.Status + ": " + string(text))
+	}
+}
+
+// ddLog converts an encoded event to an intake log. The message, host and
+// level map to Datadog's reserved attributes, the container metadata and
+// tags become ddtags, and the service defaults to the container name and
+// the source to the image's short name. All other fields stay attributes.
+func (e *ddExporter) ddLog(event []byte) (json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(event))
+	decoder.UseNumber()
+
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	tags := append([]string(nil), e.tags...)
+	for _, tag := range ddTagFields {
+		if value, ok := fields[tag.field].(string); ok && value != "" {
+			tags = append(tags, tag.tag+":"+value)
+		}
+	}
+	if values, ok := fields["tags"].([]interface{}); ok {
+		for _, value := range values {
+			if tag, ok := value.(string); ok {
+				tags = append(tags, tag)
+			}
+		}
+		delete(fields, "tags")
+	}
+	sort.Strings(tags)
+	fields["ddtags"] = strings.Join(tags, ",")
+
+	if host, ok := fields["host"]; ok {
+		fields["hostname"] = host
+		delete(fields, "host")
+	}
+
+	if _, ok := fields["service"]; !ok {
+		if name, ok := fields["container_name"].(string); ok {
+			fields["service"] = name
+		}
+	}
+
+	if e.source != "" {
+		fields["ddsource"] = e.source
+	} else if image, ok := fields["image_name"].(string); ok {
+		fields["ddsource"] = imageShortName(image)
+	}
+
+	if level, ok := fields["level"].(string); ok {
+		if status, found := ddStatuses[level]; found {
+			fields["status"] = status
+		}
+	}
+
+	// The intake takes the time from "date" but doesn't know @timestamp.
+	if timestamp, ok := fields["@timestamp"]; ok {
+		fields["date"] = timestamp
+		delete(fields, "@timestamp")
+	}
+	delete(fields, "@version")
+
+	return json.Marshal(fields)
+}
+
+// imageShortName returns an image's name without registry, repository or
+// tag, e.g. nginx for docker.io/library/nginx:1.21.
+func imageShortName(image string) string {
+	if at := strings.Index(image, "@"); at >= 0 {
+		image = image[:at]
+	}
+	if slash := strings.LastIndex(image, "/"); slash >= 0 {
+		image = image[slash+1:]
+	}
+	if colon := strings.Index(image, ":"); colon >= 0 {
+		image = image[:colon]
+	}
+	return image
+}
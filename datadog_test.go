@@ -0,0 +1,68 @@
+package logstash
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestDDSplitPayloadFailed checks that when one of the requests a batch is
+// split into fails, only its events are returned as undelivered.
+func TestDDSplitPayloadFailed(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var logs []struct {
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(reader).Decode(&logs); err != nil {
+			t.Error(err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, log := range logs {
+			received = append(received, log.Message[:5])
+		}
+		if len(received) > 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	e := &ddExporter{
+		url:     server.URL,
+		apiKey:  "key",
+		backoff: &backoff{initial: time.Millisecond, max: time.Millisecond, multiplier: 1},
+		client:  server.Client(),
+	}
+
+	// Four events of 1.3MB take two requests to stay under the payload limit.
+	var batch [][]byte
+	for _, name := range []string{"one  ", "two  ", "three", "four "} {
+		batch = append(batch, []byte(`{"message":"`+name+strings.Repeat("x", 1300<<10)+`"}`))
+	}
+
+	failed, err := e.export(batch)
+	if err == nil {
+		t.Fatal("export succeeded with a failed request")
+	}
+	if len(failed) != 2 || string(failed[0][12:17]) != "three" || string(failed[1][12:17]) != "four " {
+		t.Errorf("%d events returned as failed, want the two of the failed request", len(failed))
+	}
+	if strings.Join(received, ",") != "one  ,two  ,three,four " {
+		t.Errorf("intake received %q", received)
+	}
+}
@@ -0,0 +1,167 @@
+package logstash
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons recorded with dead-lettered events.
+const (
+	deadLetterMarshal  = "marshal"
+	deadLetterSize     = "size"
+	deadLetterWrite    = "write"
+	deadLetterNoServer = "connection_down"
+)
+
+// deadLetterWriteTimeout bounds writes to a dead-letter endpoint when the
+// write_timeout option isn't set.
+const deadLetterWriteTimeout = 10 * time.Second
+
+// deadLetter records events that could not be delivered, either appending
+// them to a local file or sending them to a secondary tcp:// or udp://
+// endpoint, one JSON object per line. A nil *deadLetter only logs.
+//
+// Redials of an endpoint are spaced as set by the backoff options, and the
+// records of events that fail in between are dropped, so a down endpoint
+// doesn't hold up the sender.
+type deadLetter struct {
+	network      string
+	target       string
+	backoff      *backoff
+	writeTimeout time.Duration
+
+	mu           sync.Mutex
+	w            io.WriteCloser
+	dialFailures int
+	nextDial     time.Time
+}
+
+// deadLetterRecord is the structured form of a dead-lettered event.
+type deadLetterRecord struct {
+	Time          string `json:"@timestamp"`
+	Reason        string `json:"reason"`
+	Error         string `json:"error"`
+	ContainerID   string `json:"container_id,omitempty"`
+	ContainerName string `json:"container_name,omitempty"`
+	Event         string `json:"event,omitempty"`
+}
+
+// newDeadLetter opens the dead-letter sink named by the dead_letter option.
+// Writes to endpoints time out after writeTimeout, or a default when it is
+// zero.
+func newDeadLetter(target string, backoff *backoff, writeTimeout time.Duration) (*deadLetter, error) {
+	if target == "" {
+		return nil, nil
+	}
+
+	if writeTimeout == 0 {
+		writeTimeout = deadLetterWriteTimeout
+	}
+	d := &deadLetter{target: target, backoff: backoff, writeTimeout: writeTimeout}
+
+	for _, network := range []string{"tcp", "udp"} {
+		if strings.HasPrefix(target, network+"://") {
+			d.network = network
+			d.target = strings.TrimPrefix(target, network+"://")
+			if _, _, err := net.SplitHostPort(d.target); err != nil {
+				return nil, errors.New("logstash: invalid dead_letter: " + err.Error())
+			}
+			return d, nil
+		}
+	}
+
+	if strings.Contains(target, "://") {
+		return nil, errors.New("logstash: invalid dead_letter: must be a file path, tcp:// or udp:// address: " + target)
+	}
+
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	d.w = file
+
+	return d, nil
+}
+
+// write records an undeliverable event. m describes the event when it is
+// known, and event holds its encoded form when it could be encoded.
+func (d *deadLetter) write(reason string, cause error, m *Message, event []byte) {
+	if d == nil {
+		return
+	}
+
+	record := deadLetterRecord{
+		Time:   time.Now().UTC().Format(timestampLayout),
+		Reason: reason,
+		Error:  cause.Error(),
+		Event:  string(event),
+	}
+	if m != nil {
+		record.ContainerID = m.ID
+		record.ContainerName = m.Name
+		if event == nil {
+			record.Event = m.Message
+		}
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		logError("logstash_deadletter:", err)
+		return
+	}
+	line = append(line, '\n')
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.w == nil && !d.redial() {
+		logWarn("logstash_deadletter: endpoint down, dropped record of event from", record.ContainerID)
+		return
+	}
+
+	if d.network == "" {
+		if _, err := d.w.Write(line); err != nil {
+			logError("logstash_deadletter:", err)
+		}
+		return
+	}
+
+	conn := d.w.(net.Conn)
+	conn.SetWriteDeadline(time.Now().Add(d.writeTimeout))
+	if _, err := conn.Write(line); err != nil {
+		logError("logstash_deadletter:", err)
+
+		// Reconnect after the backoff; files are left open.
+		conn.Close()
+		d.w = nil
+		d.dialFailures++
+		d.nextDial = time.Now().Add(d.backoff.delay(d.dialFailures))
+		return
+	}
+	d.dialFailures = 0
+}
+
+// redial connects to the endpoint unless the previous attempt failed less
+// than a backoff delay ago. It must be called with d.mu held.
+func (d *deadLetter) redial() bool {
+	if time.Now().Before(d.nextDial) {
+		return false
+	}
+
+	conn, err := net.DialTimeout(d.network, d.target, dialTimeout)
+	if err != nil {
+		logError("logstash_deadletter:", err)
+		d.dialFailures++
+		d.nextDial = time.Now().Add(d.backoff.delay(d.dialFailures))
+		return false
+	}
+
+	d.w = conn
+	return true
+}
@@ -0,0 +1,71 @@
+package logstash
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterEndpoint(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	d, err := newDeadLetter("tcp://"+ln.Addr().String(), &backoff{initial: time.Hour, max: time.Hour, multiplier: 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.write(deadLetterSize, errors.New("too big"), &Message{ID: "abc", Name: "web"}, []byte(`{"message":"hi"}`))
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record deadLetterRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Reason != deadLetterSize || record.Error != "too big" || record.ContainerID != "abc" || record.Event != `{"message":"hi"}` {
+		t.Errorf("unexpected record %+v", record)
+	}
+}
+
+// TestDeadLetterBackoff checks that records are dropped rather than redialed
+// while the endpoint is down.
+func TestDeadLetterBackoff(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+
+	d, err := newDeadLetter("tcp://"+address, &backoff{initial: time.Hour, max: time.Hour, multiplier: 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		d.write(deadLetterWrite, errConnectionDown, nil, []byte("event"))
+	}
+
+	if d.dialFailures != 1 {
+		t.Errorf("dialed %d times, want 1", d.dialFailures)
+	}
+	if d.w != nil || !d.nextDial.After(time.Now()) {
+		t.Errorf("expected a pending redial, got w=%v nextDial=%v", d.w, d.nextDial)
+	}
+}
@@ -0,0 +1,169 @@
+package logstash
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// addressLabel is the container label sending its events to another
+// address, which must be listed in the address_allowlist option.
+const addressLabel = "logstash.address"
+
+// destinationExcluded are the options not copied to the adapters of label
+// destinations, because they only make sense once per route. Events are
+// encoded by the route's adapter, so its destinations only send them.
+var destinationExcluded = map[string]bool{
+	"address_allowlist": true,
+	"startup_check":     true,
+	"mirror":            true,
+	"mirror_codec":      true,
+	"config_watch":      true,
+	"spool_dir":         true,
+	"stats_interval":    true,
+	"stats_output":      true,
+	"docker_events":     true,
+	"ecs_metadata":      true,
+}
+
+// destinations holds the adapters of the addresses containers selected with
+// their logstash.address label. Each has its own connections, spool and
+// senders, and is created when its first event is sent.
+type destinations struct {
+	parent  *Adapter
+	allowed map[string]bool
+
+	mu   sync.Mutex
+	pool map[string]*destination
+	wg   sync.WaitGroup
+}
+
+// destination is the adapter of one address and the queues of its
+// connections.
+type destination struct {
+	adapter *Adapter
+	queues  []chan *encodeBuffer
+}
+
+// newDestinations allows the addresses of the address_allowlist option.
+// Entries without a port allow any port of the host.
+func newDestinations(parent *Adapter, allowlist []string) *destinations {
+	d := &destinations{
+		parent:  parent,
+		allowed: make(map[string]bool),
+		pool:    make(map[string]*destination),
+	}
+	for _, address := range allowlist {
+		d.allowed[address] = true
+	}
+	return d
+}
+
+// allows reports whether address is in the allowlist.
+func (d *destinations) allows(address string) bool {
+	if d.allowed[address] {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	return err == nil && d.allowed[host]
+}
+
+// labelDestination returns the address a container's events are sent to
+// when its logstash.address label overrides the route's, or "". Addresses
+// that aren't allowed are logged and ignored.
+func (a *Adapter) labelDestination(labels map[string]string, id string) string {
+	address := strings.TrimSpace(labels[addressLabel])
+	if address == "" || address == a.address {
+		return ""
+	}
+
+	if a.destinations == nil {
+		logWarn("logstash_labels: ignoring "+addressLabel+" label on", id+": address_allowlist is not set")
+		return ""
+	}
+	if !a.destinations.allows(address) {
+		logWarn("logstash_labels: ignoring "+addressLabel+" label on", id+":", address, "is not in address_allowlist")
+		return ""
+	}
+
+	return address
+}
+
+// queue returns the queue of the connection carrying a container's events
+// to address, creating the destination's adapter first if needed. It
+// returns nil if the adapter can't be created, and creating it is tried
+// again with the next event.
+func (d *destinations) queue(address, id string) chan<- *encodeBuffer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dest := d.pool[address]
+	if dest == nil {
+		if dest = d.open(address); dest == nil {
+			return nil
+		}
+		d.pool[address] = dest
+	}
+
+	return dest.queues[shardFor(id, len(dest.queues))]
+}
+
+// open creates the adapter for address and starts its senders. Each sender
+// dials its connection before sending, and a connection that fails its
+// check is dialed in the background, so a destination that is down doesn't
+// hold up the others.
+func (d *destinations) open(address string) *destination {
+	options := map[string]string{"startup_check": startupLazy}
+	for key, value := range d.parent.options {
+		if !destinationExcluded[key] {
+			options[key] = value
+		}
+	}
+	if dir := d.parent.options["spool_dir"]; dir != "" {
+		options["spool_dir"] = filepath.Join(dir, "destinations", strings.NewReplacer(":", "_", "/", "_").Replace(address))
+	}
+
+	// The config file's options are already part of the route's options.
+	adapter, err := buildAdapter(&router.Route{
+		Adapter: d.parent.route.Adapter,
+		Address: address,
+		Options: options,
+	}, new(Config))
+	if err != nil {
+		logError("logstash_destination: unable to send to", address+":", err)
+		return nil
+	}
+	logInfo("logstash: sending labelled containers' events to", address)
+
+	dest := &destination{adapter: adapter}
+	for i := range adapter.conns {
+		queue := make(chan *encodeBuffer, d.parent.queueSize)
+		dest.queues = append(dest.queues, queue)
+
+		d.wg.Add(1)
+		go func(shard int) {
+			defer d.wg.Done()
+			adapter.connectShard(shard)
+			adapter.send(shard, queue)
+		}(i)
+	}
+
+	return dest
+}
+
+// close stops the senders once their queues are drained. No events may be
+// queued after it is called.
+func (d *destinations) close() {
+	d.mu.Lock()
+	for _, dest := range d.pool {
+		for _, queue := range dest.queues {
+			close(queue)
+		}
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
@@ -0,0 +1,107 @@
+package logstash
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// TestDestinationDialedInBackground checks that a destination whose
+// endpoint doesn't answer its check doesn't hold up the caller, and gets
+// its events once the endpoint answers.
+func TestDestinationDialedInBackground(t *testing.T) {
+	route := newESServer(t)
+	defer route.Close()
+
+	tenant := newESServer(t)
+	defer tenant.Close()
+
+	release := make(chan struct{})
+	var once sync.Once
+	answer := func() { once.Do(func() { close(release) }) }
+	defer answer()
+
+	handler := tenant.Config.Handler
+	tenant.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		handler.ServeHTTP(w, r)
+	})
+
+	adapter, err := newAdapter(&router.Route{
+		Adapter: "logstash+es",
+		Address: route.address(),
+		Options: map[string]string{"address_allowlist": tenant.address(), "es_flush_interval": "10ms"},
+	}, new(Config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeConns(adapter.conns)
+
+	start := time.Now()
+	queue := adapter.destinations.queue(tenant.address(), "abc")
+	if queue == nil {
+		t.Fatal("no queue for the destination")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("creating the destination took %v", elapsed)
+	}
+
+	buf := bufferPool.Get().(*encodeBuffer)
+	buf.WriteString(`{"message":"tenant"}`)
+	queue <- buf
+	answer()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tenant.mu.Lock()
+		sources := strings.Join(tenant.sources, ",")
+		tenant.mu.Unlock()
+		if sources == `{"message":"tenant"}` {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("destination indexed %q", sources)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestDestinationRetried checks that a destination whose adapter couldn't
+// be created is tried again with the next event.
+func TestDestinationRetried(t *testing.T) {
+	server := newESServer(t)
+	defer server.Close()
+
+	// A file in the way of the destinations' spools.
+	dir := t.TempDir()
+	blocker := filepath.Join(dir, "destinations")
+	if err := ioutil.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	adapter, err := newAdapter(&router.Route{
+		Adapter: "logstash+es",
+		Address: server.address(),
+		Options: map[string]string{"address_allowlist": "tenant:9200", "spool_dir": dir},
+	}, new(Config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeConns(adapter.conns)
+
+	if queue := adapter.destinations.queue("tenant:9200", "abc"); queue != nil {
+		t.Fatal("got a queue for a destination that couldn't be created")
+	}
+
+	os.Remove(blocker)
+	if queue := adapter.destinations.queue("tenant:9200", "abc"); queue == nil {
+		t.Error("destination not created once its spool could be")
+	}
+}
@@ -0,0 +1,202 @@
+package logstash
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"time"
+)
+
+// dialTimeout bounds connection setup, including any proxy handshake.
+const dialTimeout = 10 * time.Second
+
+// defaultKeepAlive is the TCP keepalive interval, Go's default for dialed
+// connections.
+const defaultKeepAlive = 15 * time.Second
+
+// IP families accepted by the ip_family option.
+const (
+	ipFamilyAny = "any"
+	ipFamilyV4  = "ipv4"
+	ipFamilyV6  = "ipv6"
+)
+
+// networkFor returns the network name restricted to the IP family, e.g.
+// "udp6" for udp and ipv6.
+func networkFor(network, family string) string {
+	switch family {
+	case ipFamilyV4:
+		return network + "4"
+	case ipFamilyV6:
+		return network + "6"
+	}
+	return network
+}
+
+// dialer opens TCP connections, through a SOCKS5 or HTTP CONNECT proxy when
+// the proxy option is set.
+//
+// Without a forced IP family, host names resolving to both IPv4 and IPv6
+// addresses are dialed with Happy Eyeballs (RFC 6555): the preferred family
+// is tried first and the other one races it after a short delay.
+type dialer struct {
+	network   string
+	keepAlive time.Duration
+	proxy     *url.URL
+	username  string
+	password  string
+}
+
+// newDialer builds a dialer from the route options.
+func newDialer(options map[string]string) (*dialer, error) {
+	family, err := enumOption(options, "ip_family", ipFamilyAny, ipFamilyAny, ipFamilyV4, ipFamilyV6)
+	if err != nil {
+		return nil, err
+	}
+
+	keepAlive, err := keepAliveOption(options)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &dialer{
+		network:   networkFor("tcp", family),
+		keepAlive: keepAlive,
+	}
+
+	value := options["proxy"]
+	if value == "" {
+		return d, nil
+	}
+
+	proxy, err := url.Parse(value)
+	if err != nil || proxy.Host == "" {
+		return nil, errors.New("logstash: invalid proxy: " + value)
+	}
+
+	switch proxy.Scheme {
+	case "socks5", "http":
+	default:
+		return nil, errors.New("logstash: invalid proxy: scheme must be socks5 or http: " + value)
+	}
+
+	d.proxy = proxy
+	if proxy.User != nil {
+		d.username = proxy.User.Username()
+		d.password, _ = proxy.User.Password()
+	}
+	if username := options["proxy_username"]; username != "" {
+		d.username = username
+	}
+	if password := options["proxy_password"]; password != "" {
+		d.password = password
+	}
+
+	return d, nil
+}
+
+// dial connects to addr. With a proxy, the IP family applies to the
+// connection to the proxy, as the proxy resolves addr itself.
+func (d *dialer) dial(addr string) (net.Conn, error) {
+	netDialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: d.keepAlive}
+
+	if d.proxy == nil {
+		return netDialer.Dial(d.network, addr)
+	}
+
+	conn, err := netDialer.Dial(d.network, d.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+
+	if d.proxy.Scheme == "socks5" {
+		err = d.socks5(conn, addr)
+	} else {
+		conn, err = d.connect(conn, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// keepAliveOption returns the TCP keepalive interval selected by the
+// keepalive and keepalive_interval options, or a negative interval when
+// keepalives are disabled, as for net.Dialer.
+func keepAliveOption(options map[string]string) (time.Duration, error) {
+	enabled, err := boolOption(options, "keepalive", true)
+	if err != nil {
+		return 0, err
+	}
+	interval, err := durationOption(options, "keepalive_interval", defaultKeepAlive)
+	if err != nil {
+		return 0, err
+	}
+	if interval <= 0 {
+		return 0, errors.New("logstash: invalid keepalive_interval: must be positive")
+	}
+
+	if !enabled {
+		return -1, nil
+	}
+	return interval, nil
+}
+
+// setKeepAlive configures TCP keepalives on conn, or on the TCP connection
+// underneath a TLS connection. Other connections are left alone.
+func setKeepAlive(conn net.Conn, interval time.Duration) error {
+	if wrapped, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = wrapped.NetConn()
+	}
+
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if interval < 0 {
+		return tcp.SetKeepAlive(false)
+	}
+	if err := tcp.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcp.SetKeepAlivePeriod(interval)
+}
+
+// tcpTransport is a plain TCP transport used in place of logspout's tcp
+// transport when a proxy or IP family is configured.
+type tcpTransport struct{}
+
+// Dial implements the router.AdapterTransport interface.
+func (t *tcpTransport) Dial(addr string, options map[string]string) (net.Conn, error) {
+	d, err := newDialer(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.dial(addr)
+}
+
+// udpTransport is used in place of logspout's udp transport when an IP
+// family is configured.
+type udpTransport struct{}
+
+// Dial implements the router.AdapterTransport interface.
+func (t *udpTransport) Dial(addr string, options map[string]string) (net.Conn, error) {
+	family, err := enumOption(options, "ip_family", ipFamilyAny, ipFamilyAny, ipFamilyV4, ipFamilyV6)
+	if err != nil {
+		return nil, err
+	}
+
+	udpAddr, err := net.ResolveUDPAddr(networkFor("udp", family), addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.DialUDP(networkFor("udp", family), nil, udpAddr)
+}
@@ -0,0 +1,108 @@
+package logstash
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ecsMetadataEnvs name the environment variables holding the ECS task
+// metadata endpoint, newest version first.
+var ecsMetadataEnvs = []string{"ECS_CONTAINER_METADATA_URI_V4", "ECS_CONTAINER_METADATA_URI"}
+
+// ecsMetadataTimeout bounds the request to the task metadata endpoint.
+const ecsMetadataTimeout = 5 * time.Second
+
+// ecsTask is the part of the task metadata response attached to events.
+type ecsTask struct {
+	Cluster     string `json:"Cluster"`
+	TaskARN     string `json:"TaskARN"`
+	Family      string `json:"Family"`
+	Revision    string `json:"Revision"`
+	ServiceName string `json:"ServiceName"`
+}
+
+// fetchECSTask reads the metadata of the task logspout runs in. It returns
+// nil fields when logspout isn't running on ECS.
+func fetchECSTask() (map[string]string, error) {
+	var endpoint string
+	for _, env := range ecsMetadataEnvs {
+		if endpoint = os.Getenv(env); endpoint != "" {
+			break
+		}
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+
+	client := &http.Client{Timeout: ecsMetadataTimeout}
+	resp, err := client.Get(endpoint + "/task")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("task metadata endpoint returned " + resp.Status)
+	}
+
+	var task ecsTask
+	if err := json.NewDecoder(resp.Body).Decode(&task); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string)
+	setNonEmpty(fields, "ecs_cluster", task.Cluster)
+	setNonEmpty(fields, "ecs_task_arn", task.TaskARN)
+	setNonEmpty(fields, "ecs_service", task.ServiceName)
+	if task.Family != "" {
+		fields["ecs_task_definition"] = task.Family + ":" + task.Revision
+	}
+
+	return fields, nil
+}
+
+// setNonEmpty sets a field unless value is empty.
+func setNonEmpty(fields map[string]string, key, value string) {
+	if value != "" {
+		fields[key] = value
+	}
+}
+
+// ecsFields returns the ECS fields of a container. logspout usually runs
+// in a task of its own, so containers of other tasks get their task from
+// the labels the ECS agent puts on them, and only share the cluster.
+func ecsFields(task map[string]string, labels map[string]string) map[string]string {
+	taskARN := labels["com.amazonaws.ecs.task-arn"]
+	if taskARN == "" || taskARN == task["ecs_task_arn"] {
+		return task
+	}
+
+	fields := make(map[string]string)
+	setNonEmpty(fields, "ecs_cluster", task["ecs_cluster"])
+	setNonEmpty(fields, "ecs_cluster", labels["com.amazonaws.ecs.cluster"])
+	fields["ecs_task_arn"] = taskARN
+	if family := labels["com.amazonaws.ecs.task-definition-family"]; family != "" {
+		fields["ecs_task_definition"] = family + ":" + labels["com.amazonaws.ecs.task-definition-version"]
+	}
+
+	return fields
+}
+
+// containerLabelFields returns the fields added to a container's events by
+// its labels: its ECS metadata with ecs_metadata, overridden by its
+// logstash.fields label.
+func (a *Adapter) containerLabelFields(labels map[string]string, id string) map[string]string {
+	fields := labelFields(labels, id)
+	if !a.ecsMetadata {
+		return fields
+	}
+
+	ecs := ecsFields(a.ecsTask, labels)
+	if len(ecs) == 0 {
+		return fields
+	}
+	return mergeFields(ecs, fields)
+}
@@ -0,0 +1,305 @@
+package logstash
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+const (
+	defaultESIndex     = "logstash-%{+yyyy.MM.dd}"
+	defaultESBatchSize = 500
+	defaultESFlush     = time.Second
+	defaultESTimeout   = 30 * time.Second
+
+	// esRetries is how many times rejected (HTTP 429) events are resent,
+	// waiting as set by the backoff options in between.
+	esRetries = 5
+)
+
+func init() {
+	router.AdapterTransports.Register(&esTransport{secure: false}, "es")
+	router.AdapterTransports.Register(&esTransport{secure: true}, "ess")
+}
+
+// esTransport bypasses Logstash and indexes events with the Elasticsearch
+// bulk API.
+type esTransport struct {
+	secure bool
+}
+
+// Dial implements the router.AdapterTransport interface.
+func (t *esTransport) Dial(addr string, options map[string]string) (net.Conn, error) {
+	pattern := options["es_index"]
+	if pattern == "" {
+		pattern = defaultESIndex
+	}
+	index, err := parseIndexPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	batchSize, err := intOption(options, "es_batch_size", defaultESBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	flushInterval, err := durationOption(options, "es_flush_interval", defaultESFlush)
+	if err != nil {
+		return nil, err
+	}
+	backoff, err := newBackoff(options)
+	if err != nil {
+		return nil, err
+	}
+	documentIDs, err := boolOption(options, "fingerprint", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each bulk request is one write.
+	client, err := newHTTPClient(addr, options, t.secure, defaultESTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "http"
+	if t.secure {
+		scheme = "https"
+	}
+
+	e := &esExporter{
+		url:         (&url.URL{Scheme: scheme, Host: addr, Path: "/_bulk"}).String(),
+		index:       index,
+		username:    options["es_username"],
+		password:    options["es_password"],
+		apiKey:      options["es_api_key"],
+		documentIDs: documentIDs,
+		backoff:     backoff,
+		client:      client,
+	}
+
+	if e.apiKey != "" && e.username != "" {
+		return nil, errors.New("logstash: es_api_key and es_username cannot be combined")
+	}
+
+	c := newBatchConn("logstash_es", batchSize, flushInterval, e.export)
+	c.probe = e.check
+	return c, nil
+}
+
+// indexPattern is a compiled index name such as logs-%{+yyyy.MM.dd}.
+type indexPattern struct {
+	// layout is the Go time layout of the date part, empty for a static name.
+	layout string
+	prefix string
+	suffix string
+}
+
+// jodaLayouts maps the Joda date tokens used by Logstash's index patterns
+// to Go layouts. Longer tokens come first so they are replaced first.
+var jodaLayouts = strings.NewReplacer(
+	"yyyy", "2006",
+	"YYYY", "2006",
+	"yy", "06",
+	"MM", "01",
+	"dd", "02",
+	"HH", "15",
+	"mm", "04",
+)
+
+// parseIndexPattern compiles an index name with an optional single
+// %{+FORMAT} date reference.
+func parseIndexPattern(pattern string) (*indexPattern, error) {
+	start := strings.Index(pattern, "%{")
+	if start < 0 {
+		return &indexPattern{prefix: pattern}, nil
+	}
+
+	end := strings.Index(pattern[start:], "}")
+	if end < 0 || !strings.HasPrefix(pattern[start:], "%{+") {
+		return nil, errors.New("logstash: invalid es_index: only %{+FORMAT} date references are supported: " + pattern)
+	}
+	end += start
+
+	if strings.Contains(pattern[end:], "%{") {
+		return nil, errors.New("logstash: invalid es_index: only one date reference is supported: " + pattern)
+	}
+
+	return &indexPattern{
+		prefix: pattern[:start],
+		layout: jodaLayouts.Replace(pattern[start+3 : end]),
+		suffix: pattern[end+1:],
+	}, nil
+}
+
+// name returns the index for an event at t.
+func (p *indexPattern) name(t time.Time) string {
+	if p.layout == "" {
+		return p.prefix
+	}
+	return p.prefix + t.UTC().Format(p.layout) + p.suffix
+}
+
+// esExporter indexes batches of events with bulk requests.
+type esExporter struct {
+	url         string
+	index       *indexPattern
+	username    string
+	password    string
+	apiKey      string
+	documentIDs bool
+	backoff     *backoff
+	client      *http.Client
+}
+
+// export sends the batch, retrying events rejected with HTTP 429, and
+// returns the events that weren't indexed.
+func (e *esExporter) export(batch [][]byte) ([][]byte, error) {
+	var rejected [][]byte
+	for attempt := 0; len(batch) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt > esRetries {
+				return append(rejected, batch...), errors.New("dropped " + strconv.Itoa(len(batch)) + " events after repeated 429 responses")
+			}
+			time.Sleep(e.backoff.delay(attempt))
+		}
+
+		retry, failed, err := e.bulk(batch)
+		if err != nil {
+			return append(rejected, batch...), err
+		}
+		rejected = append(rejected, failed...)
+		batch = retry
+	}
+
+	if len(rejected) > 0 {
+		return rejected, errors.New(strconv.Itoa(len(rejected)) + " events rejected by the bulk API")
+	}
+	return nil, nil
+}
+
+// esBulkResponse is the part of the bulk API response used to find
+// rejected events.
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// check sends a HEAD request to the cluster's root.
+func (e *esExporter) check() error {
+	req, err := http.NewRequest("HEAD", strings.TrimSuffix(e.url, "_bulk"), nil)
+	if err != nil {
+		return err
+	}
+	e.authenticate(req)
+	return checkHTTP(e.client, req)
+}
+
+// authenticate adds the configured credentials to req.
+func (e *esExporter) authenticate(req *http.Request) {
+	if e.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+e.apiKey)
+	} else if e.username != "" {
+		req.SetBasicAuth(e.username, e.password)
+	}
+}
+
+// bulk sends one bulk request and returns the events to retry and those
+// rejected for good.
+func (e *esExporter) bulk(batch [][]byte) (retry, rejected [][]byte, err error) {
+	var body bytes.Buffer
+	for _, event := range batch {
+		t, fingerprint := e.esAction(event)
+		body.WriteString(`{"index":{"_index":`)
+		name, _ := json.Marshal(e.index.name(t))
+		body.Write(name)
+		if fingerprint != "" {
+			// Resending an event overwrites its document instead of
+			// duplicating it.
+			id, _ := json.Marshal(fingerprint)
+			body.WriteString(`,"_id":`)
+			body.Write(id)
+		}
+		body.WriteString("}}\n")
+		body.Write(event)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest("POST", e.url, &body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	e.authenticate(req)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		io.Copy(ioutil.Discard, resp.Body)
+		return batch, nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		text, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, nil, errors.New("bulk request failed: " + resp.Status + ": " + string(text))
+	}
+
+	var result esBulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, nil, err
+	}
+	if !result.Errors {
+		return nil, nil, nil
+	}
+
+	for i, item := range result.Items {
+		if i >= len(batch) {
+			break
+		}
+		for _, status := range item {
+			switch {
+			case status.Status == http.StatusTooManyRequests:
+				retry = append(retry, batch[i])
+			case status.Status >= 300:
+				logError("logstash_es: event rejected:", status.Status, string(status.Error))
+				rejected = append(rejected, batch[i])
+			}
+		}
+	}
+
+	return retry, rejected, nil
+}
+
+// esAction returns the @timestamp of an encoded event, or the current time
+// if it has none, and its fingerprint. The event is only decoded when the
+// index name or the document ID depends on it.
+func (e *esExporter) esAction(event []byte) (time.Time, string) {
+	if e.index.layout == "" && !e.documentIDs {
+		return time.Time{}, ""
+	}
+
+	var fields struct {
+		Timestamp   time.Time `json:"@timestamp"`
+		Fingerprint string    `json:"fingerprint"`
+	}
+	if json.Unmarshal(event, &fields) != nil || fields.Timestamp.IsZero() {
+		fields.Timestamp = time.Now()
+	}
+	return fields.Timestamp, fields.Fingerprint
+}
@@ -0,0 +1,327 @@
+package logstash
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// esServer is a fake bulk endpoint recording the action and source lines
+// it receives. status, if set, answers requests instead of indexing them,
+// and items, if set, gives the status of each event of a request.
+type esServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests int
+	actions  []map[string]map[string]string
+	sources  []string
+	status   func(request int) int
+	items    func(source string) int
+}
+
+func newESServer(t *testing.T) *esServer {
+	s := new(esServer)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			return
+		}
+		if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+
+		s.mu.Lock()
+		s.requests++
+		request := s.requests
+		s.mu.Unlock()
+
+		if s.status != nil {
+			if status := s.status(request); status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+		}
+
+		var items []string
+		scanner := bufio.NewScanner(r.Body)
+		s.mu.Lock()
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				t.Errorf("bad action line %q: %v", scanner.Text(), err)
+			}
+			if !scanner.Scan() {
+				t.Error("action line without a source")
+			}
+			s.actions = append(s.actions, action)
+			s.sources = append(s.sources, scanner.Text())
+			if s.items != nil {
+				items = append(items, `{"index":{"status":`+strconv.Itoa(s.items(scanner.Text()))+`,"error":{"type":"test"}}}`)
+			}
+		}
+		s.mu.Unlock()
+
+		if items != nil {
+			w.Write([]byte(`{"errors":true,"items":[` + strings.Join(items, ",") + `]}`))
+			return
+		}
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}))
+	return s
+}
+
+func (s *esServer) address() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+func dialES(t *testing.T, address string, options map[string]string) *batchConn {
+	conn, err := (&esTransport{}).Dial(address, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.(*batchConn)
+}
+
+func TestESBulk(t *testing.T) {
+	server := newESServer(t)
+	defer server.Close()
+
+	conn := dialES(t, server.address(), map[string]string{
+		"es_index":      "logs-%{+yyyy.MM.dd}",
+		"es_batch_size": "2",
+		"fingerprint":   "true",
+	})
+
+	events := []string{
+		`{"message":"one","@timestamp":"2024-05-01T12:00:00.000Z","fingerprint":"f1"}`,
+		`{"message":"two","@timestamp":"2024-05-02T12:00:00.000Z"}`,
+		`{"message":"three","@timestamp":"2024-05-03T12:00:00.000Z"}`,
+	}
+	for _, event := range events {
+		if _, err := conn.Write([]byte(event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if server.requests != 2 {
+		t.Errorf("sent %d requests, want 2", server.requests)
+	}
+	if strings.Join(server.sources, "\n") != strings.Join(events, "\n") {
+		t.Errorf("indexed %q, want %q", server.sources, events)
+	}
+	for i, index := range []string{"logs-2024.05.01", "logs-2024.05.02", "logs-2024.05.03"} {
+		if i < len(server.actions) && server.actions[i]["index"]["_index"] != index {
+			t.Errorf("action %d is %v, want index %s", i, server.actions[i], index)
+		}
+	}
+	if len(server.actions) > 1 && (server.actions[0]["index"]["_id"] != "f1" || server.actions[1]["index"]["_id"] != "") {
+		t.Errorf("document IDs not taken from fingerprints: %v", server.actions)
+	}
+}
+
+func TestESFailedBatch(t *testing.T) {
+	server := newESServer(t)
+	defer server.Close()
+	server.status = func(int) int { return http.StatusBadRequest }
+
+	conn := dialES(t, server.address(), map[string]string{"es_batch_size": "2"})
+
+	var failed [][]byte
+	conn.setFailureHandler(func(batch [][]byte, err error) {
+		failed = append(failed, batch...)
+	})
+
+	for _, event := range []string{`{"message":"one"}`, `{"message":"two"}`} {
+		if _, err := conn.Write([]byte(event)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	conn.Close()
+
+	if len(failed) != 2 || string(failed[1]) != `{"message":"two"}` {
+		t.Errorf("failure handler got %q", failed)
+	}
+}
+
+// TestESRetriedEventsFailed checks that only the events still rejected with
+// 429 after the retries are handed to the failure handler.
+func TestESRetriedEventsFailed(t *testing.T) {
+	server := newESServer(t)
+	defer server.Close()
+	server.items = func(source string) int {
+		if source == `{"message":"two"}` {
+			return http.StatusTooManyRequests
+		}
+		return http.StatusCreated
+	}
+
+	conn := dialES(t, server.address(), map[string]string{
+		"es_batch_size":   "2",
+		"backoff_initial": "1ms",
+		"backoff_max":     "1ms",
+		"backoff_jitter":  "false",
+	})
+
+	var failed []string
+	conn.setFailureHandler(func(batch [][]byte, err error) {
+		for _, event := range batch {
+			failed = append(failed, string(event))
+		}
+	})
+
+	conn.Write([]byte(`{"message":"one"}`))
+	conn.Write([]byte(`{"message":"two"}`))
+	conn.Close()
+
+	if len(failed) != 1 || failed[0] != `{"message":"two"}` {
+		t.Errorf("failure handler got %q, want only the event rejected with 429", failed)
+	}
+}
+
+// TestESRejectedEventsFailed checks that events the bulk API rejects for
+// good are handed to the failure handler, and the others aren't.
+func TestESRejectedEventsFailed(t *testing.T) {
+	server := newESServer(t)
+	defer server.Close()
+	server.items = func(source string) int {
+		if source == `{"message":"two"}` {
+			return http.StatusBadRequest
+		}
+		return http.StatusCreated
+	}
+
+	conn := dialES(t, server.address(), map[string]string{"es_batch_size": "3"})
+
+	var failed []string
+	var failure error
+	conn.setFailureHandler(func(batch [][]byte, err error) {
+		for _, event := range batch {
+			failed = append(failed, string(event))
+		}
+		failure = err
+	})
+
+	for _, event := range []string{`{"message":"one"}`, `{"message":"two"}`, `{"message":"three"}`} {
+		conn.Write([]byte(event))
+	}
+	conn.Close()
+
+	if len(failed) != 1 || failed[0] != `{"message":"two"}` {
+		t.Errorf("failure handler got %q, want only the rejected event", failed)
+	}
+	if failure == nil || !strings.Contains(failure.Error(), "1 events rejected") {
+		t.Errorf("failure error = %v", failure)
+	}
+}
+
+func TestESRetries(t *testing.T) {
+	server := newESServer(t)
+	defer server.Close()
+	server.status = func(request int) int {
+		if request == 1 {
+			return http.StatusTooManyRequests
+		}
+		return http.StatusOK
+	}
+
+	conn := dialES(t, server.address(), map[string]string{
+		"es_batch_size":   "1",
+		"backoff_initial": "10ms",
+		"backoff_max":     "10ms",
+		"backoff_jitter":  "false",
+	})
+
+	start := time.Now()
+	conn.Write([]byte(`{"message":"one"}`))
+	conn.Close()
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.requests != 2 || len(server.sources) != 1 {
+		t.Errorf("sent %d requests indexing %q, want the event resent once", server.requests, server.sources)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Error("resent without waiting")
+	}
+}
+
+// TestESWriteDuringFlush checks that events can be written while a timed
+// flush waits for a slow cluster.
+func TestESWriteDuringFlush(t *testing.T) {
+	server := newESServer(t)
+	defer server.Close()
+
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	server.status = func(request int) int {
+		if request == 1 {
+			close(sending)
+			<-release
+		}
+		return http.StatusOK
+	}
+
+	conn := dialES(t, server.address(), map[string]string{
+		"es_batch_size":     "100",
+		"es_flush_interval": "10ms",
+	})
+	defer conn.Close()
+
+	conn.Write([]byte(`{"message":"one"}`))
+	<-sending
+
+	written := make(chan struct{})
+	go func() {
+		conn.Write([]byte(`{"message":"two"}`))
+		close(written)
+	}()
+
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Error("write blocked by the flush in progress")
+	}
+	close(release)
+}
+
+// TestESReshapingRejected checks that options moving the fields read by the
+// HTTP outputs are refused.
+func TestESReshapingRejected(t *testing.T) {
+	server := newESServer(t)
+	defer server.Close()
+
+	for _, options := range []map[string]string{
+		{"rename": "host:hostname"},
+		{"omit": "image_name"},
+		{"nest_docker": "true"},
+	} {
+		_, err := newAdapter(&router.Route{Adapter: "logstash+es", Address: server.address(), Options: options}, new(Config))
+		if err == nil || !strings.Contains(err.Error(), "not supported by the es transport") {
+			t.Errorf("%v: error = %v", options, err)
+		}
+	}
+
+	adapter, err := newAdapter(&router.Route{
+		Adapter: "logstash+es",
+		Address: server.address(),
+		Options: map[string]string{"nest_docker": "false", "timestamp_layouts": "iso8601"},
+	}, new(Config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeConns(adapter.conns)
+}
@@ -0,0 +1,175 @@
+package logstash
+
+import (
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// lifecycleMessages are the container lifecycle actions shipped with
+// docker_events, mapped to the message text of their events.
+var lifecycleMessages = map[string]string{
+	"start": "started",
+	"stop":  "stopped",
+	"die":   "died",
+	"oom":   "ran out of memory",
+}
+
+// healthAction prefixes the action of healthcheck events, which is followed
+// by the new status, e.g. "health_status: unhealthy".
+const healthAction = "health_status: "
+
+// watchDocker ships container lifecycle events from the Docker events
+// stream until done is closed. Events are sent on the shard of their
+// container, so they stay in order with its log lines. When the stream is
+// lost it is subscribed to again, waiting as set by the backoff options.
+func (a *Adapter) watchDocker(shards []chan *Message, done <-chan struct{}) {
+	client, err := docker.NewClientFromEnv()
+	if err != nil {
+		logError("logstash_events:", err)
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-done:
+				return
+			case <-time.After(a.backoff.delay(attempt)):
+			}
+		}
+
+		listener := make(chan *docker.APIEvents, 64)
+		if err := client.AddEventListener(listener); err != nil {
+			logError("logstash_events:", err)
+			continue
+		}
+
+		stopped := a.shipEvents(client, listener, shards, done)
+		client.RemoveEventListener(listener)
+		if stopped {
+			return
+		}
+		logWarn("logstash_events: events stream closed, subscribing again")
+		attempt = 0
+	}
+}
+
+// shipEvents ships the events received on listener until done is closed,
+// which it reports, or the listener is closed.
+func (a *Adapter) shipEvents(client *docker.Client, listener <-chan *docker.APIEvents, shards []chan *Message, done <-chan struct{}) bool {
+	for {
+		var event *docker.APIEvents
+		var ok bool
+
+		select {
+		case <-done:
+			return true
+		case event, ok = <-listener:
+			if !ok {
+				return false
+			}
+		}
+
+		if event == nil || event.Type != "container" {
+			continue
+		}
+
+		// The probe output isn't part of the event, so it is read from the
+		// container's health log.
+		var probeOutput string
+		if strings.HasPrefix(event.Action, healthAction) {
+			probeOutput = healthOutput(client, event.Actor.ID)
+		}
+
+		message := a.lifecycleEvent(event, probeOutput)
+		if message == nil {
+			continue
+		}
+
+		select {
+		case shards[shardFor(event.Actor.ID, len(shards))] <- message:
+		case <-done:
+			*message = Message{}
+			messagePool.Put(message)
+			return true
+		}
+	}
+}
+
+// healthOutput returns the output of the container's latest healthcheck
+// probe.
+func healthOutput(client *docker.Client, id string) string {
+	container, err := client.InspectContainer(id)
+	if err != nil {
+		logWarn("logstash_events:", err)
+		return ""
+	}
+
+	probes := container.State.Health.Log
+	if len(probes) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(probes[len(probes)-1].Output)
+}
+
+// lifecycleEvent builds the event shipped for a Docker container event, or
+// returns nil for actions that aren't shipped. probeOutput is the latest
+// healthcheck output for health_status events.
+func (a *Adapter) lifecycleEvent(event *docker.APIEvents, probeOutput string) *Message {
+	action := event.Action
+	healthStatus := strings.TrimPrefix(action, healthAction)
+	isHealth := healthStatus != action
+
+	text, found := lifecycleMessages[action]
+	if isHealth {
+		action = strings.TrimSuffix(healthAction, ": ")
+		text, found = "is "+healthStatus, true
+	}
+	if !found {
+		return nil
+	}
+
+	attributes := event.Actor.Attributes
+	name := strings.TrimLeft(attributes["name"], "/")
+
+	text = "container " + name + " " + text
+	code, hasCode := attributes["exitCode"]
+	if hasCode && action == "die" {
+		text += " with exit code " + code
+	}
+	if isHealth && probeOutput != "" {
+		text += ": " + probeOutput
+	}
+
+	message := messagePool.Get().(*Message)
+	*message = Message{
+		Message:     text,
+		Name:        name,
+		ID:          event.Actor.ID,
+		Image:       attributes["image"],
+		Host:        a.hostname,
+		Tags:        withLabelTags(a.tags, attributes),
+		Environment: a.environment,
+		Type:        a.eventType,
+		Fields:      mergeFields(a.loadRules().fields, a.containerLabelFields(attributes, event.Actor.ID)),
+		Timestamp:   time.Unix(0, event.TimeNano),
+	}
+
+	message.setField("docker_event", action)
+	if hasCode && action == "die" {
+		message.setField("exit_code", code)
+	}
+	if isHealth {
+		message.setField("health_status", healthStatus)
+		message.setField("health_output", probeOutput)
+	}
+
+	// Event attributes include the container's labels.
+	if eventType := attributes[typeLabel]; eventType != "" {
+		message.Type = eventType
+	}
+
+	return message
+}
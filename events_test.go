@@ -0,0 +1,46 @@
+package logstash
+
+import (
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// TestShipEventsStreamClosed checks that the events queued before the events
+// stream closed are shipped, and that its loss is reported instead of
+// spinning on the closed listener.
+func TestShipEventsStreamClosed(t *testing.T) {
+	a := &Adapter{hostname: "host"}
+	a.rules.Store(&rules{})
+
+	listener := make(chan *docker.APIEvents, 2)
+	listener <- &docker.APIEvents{
+		Type:   "container",
+		Action: "die",
+		Actor:  docker.APIActor{ID: "abc", Attributes: map[string]string{"name": "web", "exitCode": "1"}},
+	}
+	close(listener)
+
+	shards := []chan *Message{make(chan *Message, 1)}
+	stopped := make(chan bool, 1)
+	go func() { stopped <- a.shipEvents(nil, listener, shards, make(chan struct{})) }()
+
+	select {
+	case done := <-stopped:
+		if done {
+			t.Error("closed stream reported as done")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shipEvents didn't return after the stream closed")
+	}
+
+	select {
+	case message := <-shards[0]:
+		if message.Message != "container web died with exit code 1" {
+			t.Errorf("shipped %q", message.Message)
+		}
+	default:
+		t.Error("event before the stream closed not shipped")
+	}
+}
@@ -0,0 +1,341 @@
+package logstash
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// defaultFileMaxSize is the size at which the output file is rotated.
+const defaultFileMaxSize = 100 << 20
+
+// fileRotatedLayout formats the time in the names of rotated files. It
+// sorts in time order.
+const fileRotatedLayout = "20060102T150405.000"
+
+func init() {
+	router.AdapterTransports.Register(new(fileTransport), "file")
+}
+
+// fileTransport appends events to a local file, one per line, rotating it
+// by size and time. The route's address is not used.
+type fileTransport struct{}
+
+// Dial implements the router.AdapterTransport interface.
+func (t *fileTransport) Dial(addr string, options map[string]string) (net.Conn, error) {
+	path := options["file_path"]
+	if path == "" {
+		return nil, errors.New("logstash: the file transport requires the file_path option")
+	}
+	maxSize, err := intOption(options, "file_max_size", defaultFileMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	interval, err := durationOption(options, "file_rotate_interval", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxBackups, err := intOption(options, "file_max_backups", 0)
+	if err != nil {
+		return nil, err
+	}
+	compress, err := boolOption(options, "file_compress", false)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	c := &fileConn{
+		path:       path,
+		maxSize:    int64(maxSize),
+		interval:   interval,
+		maxBackups: maxBackups,
+		compress:   compress,
+	}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// fileConn writes to the output file. The file is rotated before a write
+// that would take it past maxSize, or when the write falls in a later
+// interval than the file's first write. Rotated files are renamed with the
+// time of rotation, compressed in the background with compress, and the
+// oldest are removed beyond maxBackups.
+type fileConn struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	compress   bool
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	period time.Time
+	closed bool
+
+	// rotated is the time in the last rotated file's name.
+	rotated time.Time
+
+	// pruneMu serializes pruning, which also runs after compression.
+	pruneMu     sync.Mutex
+	compressing sync.WaitGroup
+}
+
+// open opens the output file for appending. An existing file keeps the
+// period of its last write.
+func (c *fileConn) open() error {
+	file, err := os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	c.file = file
+	c.size = info.Size()
+	c.period = c.periodOf(time.Now())
+	if c.size > 0 {
+		c.period = c.periodOf(info.ModTime())
+	}
+	return nil
+}
+
+// periodOf returns the rotation interval t falls in. Intervals are aligned
+// to UTC, so e.g. daily files start at midnight UTC.
+func (c *fileConn) periodOf(t time.Time) time.Time {
+	if c.interval == 0 {
+		return time.Time{}
+	}
+	return t.UTC().Truncate(c.interval)
+}
+
+// Write implements net.Conn. p holds one event, so files are only rotated
+// between events.
+func (c *fileConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, errors.New("logstash_file: use of closed file")
+	}
+
+	now := time.Now()
+	if c.size > 0 && (c.size+int64(len(p)) > c.maxSize || !c.periodOf(now).Equal(c.period)) {
+		if err := c.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := c.file.Write(p)
+	c.size += int64(n)
+	return n, err
+}
+
+// rotate renames the output file and opens a new one. It must be called
+// with c.mu held.
+func (c *fileConn) rotate(now time.Time) error {
+	if err := c.file.Close(); err != nil {
+		logError("logstash_file:", err)
+	}
+
+	// Names only have millisecond resolution, so a rotation within the
+	// millisecond of the last one, or onto a file left by another run,
+	// takes the next free time. Backups are never overwritten and sort in
+	// the order they were written, even after the oldest were pruned.
+	stamp := now.UTC().Truncate(time.Millisecond)
+	if !stamp.After(c.rotated) {
+		stamp = c.rotated.Add(time.Millisecond)
+	}
+	rotated := c.path + "." + stamp.Format(fileRotatedLayout)
+	for fileExists(rotated) || fileExists(rotated+".gz") {
+		stamp = stamp.Add(time.Millisecond)
+		rotated = c.path + "." + stamp.Format(fileRotatedLayout)
+	}
+	if err := os.Rename(c.path, rotated); err != nil {
+		// Keep appending to the current file rather than losing events.
+		logError("logstash_file: rotating", c.path+":", err)
+		return c.open()
+	}
+	c.rotated = stamp
+
+	if err := c.open(); err != nil {
+		return err
+	}
+	c.period = c.periodOf(now)
+
+	if c.compress {
+		c.compressing.Add(1)
+		go func() {
+			defer c.compressing.Done()
+			if err := compressFile(rotated); err != nil {
+				logError("logstash_file: compressing", rotated+":", err)
+			}
+			c.prune()
+		}()
+		return nil
+	}
+
+	c.prune()
+	return nil
+}
+
+// fileExists reports whether name exists.
+func fileExists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
+
+// compressFile replaces name with a gzipped copy, name.gz.
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// The copy is written under a temporary name, so a compressed file is
+	// never seen half-written.
+	tmp := name + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := gzip.NewWriter(dst)
+	_, err = io.Copy(writer, src)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Remove(name)
+}
+
+// prune removes the oldest rotated files beyond maxBackups.
+func (c *fileConn) prune() {
+	if c.maxBackups == 0 {
+		return
+	}
+
+	c.pruneMu.Lock()
+	defer c.pruneMu.Unlock()
+
+	dir, base := filepath.Split(c.path)
+	if dir == "" {
+		dir = "."
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logError("logstash_file:", err)
+		return
+	}
+
+	var rotated []string
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, base+".") {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, base+"."), ".gz")
+		if _, err := time.Parse(fileRotatedLayout, stamp); err == nil {
+			rotated = append(rotated, name)
+		}
+	}
+
+	// An uncompressed file and its compressed copy are briefly both present
+	// and count once.
+	sort.Strings(rotated)
+	var unique []string
+	for _, name := range rotated {
+		if len(unique) > 0 && strings.TrimSuffix(name, ".gz") == unique[len(unique)-1] {
+			continue
+		}
+		unique = append(unique, name)
+	}
+
+	for len(unique) > c.maxBackups {
+		stamp := filepath.Join(dir, strings.TrimSuffix(unique[0], ".gz"))
+		for _, name := range []string{stamp, stamp + ".gz"} {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				logError("logstash_file:", err)
+			}
+		}
+		unique = unique[1:]
+	}
+}
+
+// Read is not supported; the adapter only writes.
+func (c *fileConn) Read(p []byte) (int, error) {
+	return 0, errors.New("logstash_file: read not supported")
+}
+
+// Close closes the output file and waits for rotated files to be
+// compressed.
+func (c *fileConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	err := c.file.Close()
+	c.mu.Unlock()
+
+	c.compressing.Wait()
+	return err
+}
+
+// LocalAddr implements net.Conn.
+func (c *fileConn) LocalAddr() net.Addr {
+	return nil
+}
+
+// RemoteAddr implements net.Conn.
+func (c *fileConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+// SetDeadline implements net.Conn.
+func (c *fileConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *fileConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *fileConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,104 @@
+package logstash
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func dialFile(t *testing.T, options map[string]string) (*fileConn, string) {
+	dir := t.TempDir()
+	options["file_path"] = filepath.Join(dir, "events.log")
+
+	conn, err := (&fileTransport{}).Dial("", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.(*fileConn), dir
+}
+
+// readBackups returns the contents of the output file and its backups, in
+// the order they were written.
+func readBackups(t *testing.T, dir string) (int, string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, file := range files {
+		if file.Name() != "events.log" {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	names = append(names, "events.log")
+
+	var contents strings.Builder
+	for _, name := range names {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data []byte
+		if strings.HasSuffix(name, ".gz") {
+			reader, err := gzip.NewReader(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err = ioutil.ReadAll(reader)
+		} else {
+			data, err = ioutil.ReadAll(file)
+		}
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents.Write(data)
+	}
+
+	return len(names) - 1, contents.String()
+}
+
+// TestFileRotationCollisions rotates many times within a millisecond and
+// checks that no backup is overwritten.
+func TestFileRotationCollisions(t *testing.T) {
+	for _, compress := range []string{"false", "true"} {
+		conn, dir := dialFile(t, map[string]string{"file_max_size": "8", "file_compress": compress})
+
+		var want strings.Builder
+		for i := 0; i < 50; i++ {
+			event := string('a'+rune(i%26)) + "event\n"
+			if _, err := conn.Write([]byte(event)); err != nil {
+				t.Fatal(err)
+			}
+			want.WriteString(event)
+		}
+		conn.Close()
+
+		backups, got := readBackups(t, dir)
+		if backups != 49 {
+			t.Errorf("compress=%s: %d backups, want 49", compress, backups)
+		}
+		if got != want.String() {
+			t.Errorf("compress=%s: events lost or reordered:\n%s", compress, got)
+		}
+	}
+}
+
+func TestFileMaxBackups(t *testing.T) {
+	conn, dir := dialFile(t, map[string]string{"file_max_size": "8", "file_max_backups": "3"})
+	for i := 0; i < 10; i++ {
+		conn.Write([]byte("event " + string('0'+rune(i)) + "\n"))
+	}
+	conn.Close()
+
+	backups, got := readBackups(t, dir)
+	if backups != 3 || got != "event 6\nevent 7\nevent 8\nevent 9\n" {
+		t.Errorf("%d backups holding %q, want the 3 newest", backups, got)
+	}
+}
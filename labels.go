@@ -0,0 +1,90 @@
+package logstash
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// tagsLabel is the container label holding comma-separated tags added to
+// its events.
+const tagsLabel = "logstash.tags"
+
+// fieldsLabel is the container label holding fields added to its events,
+// as a JSON object or comma-separated key=value pairs.
+const fieldsLabel = "logstash.fields"
+
+// withLabelTags appends the tags from a container's logstash.tags label.
+// The shared tags slice is copied rather than modified.
+func withLabelTags(tags []string, labels map[string]string) []string {
+	if labels[tagsLabel] == "" {
+		return tags
+	}
+
+	labelTags := listOption(labels, tagsLabel)
+	if len(labelTags) == 0 {
+		return tags
+	}
+
+	merged := make([]string, 0, len(tags)+len(labelTags))
+	merged = append(merged, tags...)
+	return append(merged, labelTags...)
+}
+
+// labelFields parses a container's logstash.fields label. Invalid labels
+// and reserved field names are logged and ignored.
+func labelFields(labels map[string]string, id string) map[string]string {
+	label := strings.TrimSpace(labels[fieldsLabel])
+	if label == "" {
+		return nil
+	}
+
+	fields := make(map[string]string)
+
+	if strings.HasPrefix(label, "{") {
+		var values map[string]interface{}
+		if err := json.Unmarshal([]byte(label), &values); err != nil {
+			logWarn("logstash_labels: invalid "+fieldsLabel+" label on", id+":", err)
+			return nil
+		}
+		for key, value := range values {
+			if text, ok := value.(string); ok {
+				fields[key] = text
+			} else {
+				encoded, _ := json.Marshal(value)
+				fields[key] = string(encoded)
+			}
+		}
+	} else {
+		for _, pair := range listOption(labels, fieldsLabel) {
+			equals := strings.Index(pair, "=")
+			if equals < 0 {
+				logWarn("logstash_labels: invalid "+fieldsLabel+" label on", id+":", fmt.Sprintf("%q is not key=value", pair))
+				return nil
+			}
+			fields[strings.TrimSpace(pair[:equals])] = strings.TrimSpace(pair[equals+1:])
+		}
+	}
+
+	for key := range fields {
+		if key == "" || reservedFields[key] {
+			logWarn("logstash_labels: ignoring reserved field", key, "in "+fieldsLabel+" label on", id)
+			delete(fields, key)
+		}
+	}
+
+	return fields
+}
+
+// mergeFields returns the static fields with the label fields added; label
+// fields win.
+func mergeFields(static, label map[string]string) map[string]string {
+	fields := make(map[string]string, len(static)+len(label))
+	for key, value := range static {
+		fields[key] = value
+	}
+	for key, value := range label {
+		fields[key] = value
+	}
+	return fields
+}
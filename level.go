@@ -0,0 +1,92 @@
+package logstash
+
+import "strings"
+
+// levels are the values of the level field, which stderr_level selects from.
+var levels = []string{"trace", "debug", "info", "notice", "warn", "error", "fatal"}
+
+// levelAliases maps the level names found in log lines and syslog
+// severities to values of the level field.
+var levelAliases = map[string]string{
+	"trace":    "trace",
+	"debug":    "debug",
+	"dbg":      "debug",
+	"info":     "info",
+	"notice":   "notice",
+	"warn":     "warn",
+	"warning":  "warn",
+	"error":    "error",
+	"err":      "error",
+	"fatal":    "fatal",
+	"crit":     "fatal",
+	"critical": "fatal",
+	"alert":    "fatal",
+	"emerg":    "fatal",
+	"panic":    "fatal",
+}
+
+// levelWords is how many words at the start of a line are searched for a
+// level, enough to skip a timestamp and a logger name.
+const levelWords = 5
+
+// levelPrefix bounds how much of a line is split into words.
+const levelPrefix = 256
+
+// parseLevel finds the level of a log line. Levels are recognised as an
+// upper case or bracketed word near the start of the line, such as
+// "2024-05-01 12:00:00 ERROR" or "[warn]", or as a level=... pair or JSON
+// "level" key.
+func parseLevel(line string) (string, bool) {
+	if len(line) > levelPrefix {
+		line = line[:levelPrefix]
+	}
+
+	words := strings.Fields(line)
+	if len(words) > levelWords {
+		words = words[:levelWords]
+	}
+
+	for _, word := range words {
+		pair := strings.ToLower(strings.TrimLeft(word, "{"))
+		for _, prefix := range []string{"level=", "lvl=", `"level":`} {
+			if strings.HasPrefix(pair, prefix) {
+				value := strings.TrimPrefix(pair[len(prefix):], `"`)
+				if end := strings.IndexAny(value, `",}`); end >= 0 {
+					value = value[:end]
+				}
+				if level, found := levelAliases[value]; found {
+					return level, true
+				}
+			}
+		}
+
+		bracketed := strings.HasPrefix(word, "[") || strings.HasPrefix(word, "<")
+		word = strings.Trim(word, "[]<>():,")
+		if !bracketed && word != strings.ToUpper(word) {
+			continue
+		}
+		if level, found := levelAliases[strings.ToLower(word)]; found {
+			return level, true
+		}
+	}
+
+	return "", false
+}
+
+// applyStderrLevel sets the level field of a stderr event to the level
+// found in its text, falling back to the stderr_level option. Events that
+// already have a level field are left alone.
+func (a *Adapter) applyStderrLevel(event *Message) {
+	if event.Stream != "stderr" || event.Fields["level"] != "" {
+		return
+	}
+
+	level, found := levelAliases[event.Fields["syslog_severity"]]
+	if !found {
+		if level, found = parseLevel(event.Message); !found {
+			level = a.stderrLevel
+		}
+	}
+
+	event.setField("level", level)
+}
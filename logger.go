@@ -0,0 +1,138 @@
+package logstash
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevelEnv names the environment variable holding the adapter's own log
+// level: error, warn, info (the default) or debug.
+const logLevelEnv = "LOGSTASH_LOG_LEVEL"
+
+// Log levels, from least to most verbose.
+const (
+	levelError = iota
+	levelWarn
+	levelInfo
+	levelDebug
+)
+
+var levelNames = []string{"ERROR", "WARN", "INFO", "DEBUG"}
+
+// logBurst messages with the same prefix are logged per logInterval; the
+// rest are counted and reported once the interval is over, so a broken
+// socket doesn't flood logspout's output with identical lines.
+const (
+	logBurst    = 5
+	logInterval = time.Minute
+)
+
+// logger is the adapter's leveled, rate-limited logger. It logs at info
+// level if LOGSTASH_LOG_LEVEL is invalid, and logLevelErr makes newAdapter
+// fail.
+var logger, logLevelErr = newLeveledLogger(os.Getenv(logLevelEnv))
+
+// leveledLogger writes messages at or above its level to the standard log.
+type leveledLogger struct {
+	level int
+
+	mu     sync.Mutex
+	limits map[string]*logLimit
+	now    func() time.Time
+}
+
+// logLimit tracks the messages logged with one prefix in the current interval.
+type logLimit struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// newLeveledLogger creates a logger for the named level, defaulting to info.
+// An unknown name is an error, and the logger then logs at info level.
+func newLeveledLogger(name string) (*leveledLogger, error) {
+	l := &leveledLogger{
+		level:  levelInfo,
+		limits: make(map[string]*logLimit),
+		now:    time.Now,
+	}
+
+	if name == "" {
+		return l, nil
+	}
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) || strings.EqualFold(name, "warning") && level == levelWarn {
+			l.level = level
+			return l, nil
+		}
+	}
+
+	return l, errors.New("logstash: invalid " + logLevelEnv + ": must be error, warn, info or debug: " + name)
+}
+
+// enabled reports whether messages at level are logged.
+func (l *leveledLogger) enabled(level int) bool {
+	return level <= l.level
+}
+
+// print logs args at level. Messages are rate-limited by their first
+// argument, the "logstash_xxx:" prefix.
+func (l *leveledLogger) print(level int, args ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+
+	key := fmt.Sprint(levelNames[level], args[0])
+
+	l.mu.Lock()
+	limit, found := l.limits[key]
+	if !found {
+		limit = &logLimit{start: l.now()}
+		l.limits[key] = limit
+	}
+
+	suppressed := 0
+	if now := l.now(); now.Sub(limit.start) >= logInterval {
+		suppressed = limit.suppressed
+		limit.start, limit.count, limit.suppressed = now, 0, 0
+	}
+
+	limit.count++
+	if limit.count > logBurst {
+		limit.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	l.mu.Unlock()
+
+	line := append([]interface{}{levelNames[level]}, args...)
+	if suppressed > 0 {
+		line = append(line, fmt.Sprintf("(%d similar messages suppressed)", suppressed))
+	}
+	log.Println(line...)
+}
+
+// logError logs a failure that loses data or stops the adapter.
+func logError(args ...interface{}) {
+	logger.print(levelError, args...)
+}
+
+// logWarn logs a recoverable problem.
+func logWarn(args ...interface{}) {
+	logger.print(levelWarn, args...)
+}
+
+// logInfo logs a notable state change.
+func logInfo(args ...interface{}) {
+	logger.print(levelInfo, args...)
+}
+
+// logDebug logs detail useful when troubleshooting.
+func logDebug(args ...interface{}) {
+	logger.print(levelDebug, args...)
+}
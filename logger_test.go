@@ -0,0 +1,51 @@
+package logstash
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+func TestLogLevel(t *testing.T) {
+	cases := []struct {
+		name  string
+		level int
+		valid bool
+	}{
+		{"", levelInfo, true},
+		{"error", levelError, true},
+		{"WARN", levelWarn, true},
+		{"warning", levelWarn, true},
+		{"info", levelInfo, true},
+		{"Debug", levelDebug, true},
+		{"verbose", levelInfo, false},
+		{"warn ", levelInfo, false},
+	}
+
+	for _, c := range cases {
+		l, err := newLeveledLogger(c.name)
+		if (err == nil) != c.valid {
+			t.Errorf("newLeveledLogger(%q) error = %v", c.name, err)
+		}
+		if l.level != c.level {
+			t.Errorf("newLeveledLogger(%q) level = %d, want %d", c.name, l.level, c.level)
+		}
+	}
+}
+
+// TestInvalidLogLevelRefused checks that routes aren't created while
+// LOGSTASH_LOG_LEVEL is invalid.
+func TestInvalidLogLevelRefused(t *testing.T) {
+	defer func(err error) { logLevelErr = err }(logLevelErr)
+	_, logLevelErr = newLeveledLogger("verbose")
+
+	_, err := newAdapter(&router.Route{
+		Adapter: "logstash+file",
+		Options: map[string]string{"file_path": filepath.Join(t.TempDir(), "events.log")},
+	}, new(Config))
+	if err == nil || !strings.Contains(err.Error(), "invalid LOGSTASH_LOG_LEVEL") {
+		t.Errorf("newAdapter error = %v, want the log level refused", err)
+	}
+}
@@ -1,13 +1,19 @@
 package logstash
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
-	"log"
 	"net"
 	"regexp"
 	"strings"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/gliderlabs/logspout/router"
 )
@@ -16,70 +22,595 @@ func init() {
 	router.AdapterFactories.Register(NewAdapter, "logstash")
 }
 
-var regexps = []*regexp.Regexp{
-	regexp.MustCompile(`^\s`), // The indentation for a single traceback
-	regexp.MustCompile(`line \d+, in .+`), // line 1, in example
-	regexp.MustCompile(`Traceback `), // Traceback (most recent call last):
-	regexp.MustCompile(`LINE \d+:`), // LINE 1: <SQL STATEMENT>
+// Lines that continue the previous message:
+//
+//	^\s                  The indentation for a single traceback
+//	line \d+, in .+      line 1, in example
+//	Traceback            Traceback (most recent call last):
+//	LINE \d+:            LINE 1: <SQL STATEMENT>
+//
+// They are combined into one alternation. It is anchored, so IsMultiline
+// only tries it where a line has one of the literals the last three start
+// with, rather than at every position.
+var multilineRegexp = regexp.MustCompile(`^(?:\s|line \d+, in .|Traceback |LINE \d+:)`)
+
+// multilineLiterals start every match of multilineRegexp but indentation.
+var multilineLiterals = []string{"line ", "Traceback ", "LINE "}
+
+// maxPooledBuffer is the largest encode buffer returned to the pool, so one
+// huge traceback doesn't pin its memory for the life of the process.
+const maxPooledBuffer = 64 * 1024
+
+var messagePool = sync.Pool{
+	New: func() interface{} {
+		return new(Message)
+	},
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := new(encodeBuffer)
+		buf.encoder = json.NewEncoder(&buf.Buffer)
+		return buf
+	},
 }
 
+// encodeBuffer is a reusable buffer with a JSON encoder bound to it.
+type encodeBuffer struct {
+	bytes.Buffer
+	encoder *json.Encoder
+}
+
+// release resets the buffer and returns it to the pool.
+func (b *encodeBuffer) release() {
+	if b.Cap() > maxPooledBuffer {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
+
+// streamTransports are the transports without message boundaries; events
+// sent over them are terminated by a newline, as Logstash's json_lines codec
+// expects.
+var streamTransports = map[string]bool{
+	"tcp":  true,
+	"tls":  true,
+	"mtls": true,
+	"file": true,
+}
+
+// decodingTransports are the transports that decode the encoded events to
+// build their own requests, so they require the json codec.
+var decodingTransports = map[string]bool{
+	"es":    true,
+	"ess":   true,
+	"otlp":  true,
+	"otlps": true,
+	"dd":    true,
+}
+
+// defaultMultilineTag is the tag added to merged multiline events.
+const defaultMultilineTag = "multiline"
+
 // Adapter is an adapter that streams UDP JSON to Logstash.
 type Adapter struct {
-	conn  net.Conn
-	route *router.Route
+	conns         []net.Conn
+	pending       []chan net.Conn
+	route         *router.Route
+	transport     router.AdapterTransport
+	address       string
+	options       map[string]string
+	sendBuffer    int
+	keepAlive     time.Duration
+	writeTimeout  time.Duration
+	backoff       *backoff
+	retryAttempts int
+	redialAfter   int
+	lineFraming   bool
+	queueSize     int
+	backpressure  string
+	hostname      string
+	counters      counters
+	rules         atomic.Value // *rules
+	configPath    string
+	configWatch   time.Duration
+	tags          []string
+	mergedTags    []string
+	environment   string
+	template      *template.Template
+	parseSyslog   bool
+	stderrLevel   string
+	multiline     bool
+	buffers       *bufferBudget
+	keepLines     bool
+	ecsMetadata   bool
+	ecsTask       map[string]string
+	timestamps    *timestampParser
+	schema        *schema
+	codec         codec
+	eventType     string
+	maxEventSize  int
+	deadLetter    *deadLetter
+	spools        []*spool
+	statsInterval time.Duration
+	statsOutput   string
+	dockerEvents  bool
+	mirror        *Adapter
+	destinations  *destinations
+	joinPartial   bool
+	sequence      bool
+	fingerprint   bool
+	startupCheck  string
 }
 
 // NewAdapter creates an Adapter with UDP as the default transport.
 func NewAdapter(route *router.Route) (router.LogAdapter, error) {
-	transport, found := router.AdapterTransports.Lookup(route.AdapterTransport("udp"))
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	return newAdapter(route, config)
+}
+
+// newAdapter creates an Adapter for the route with the given config file
+// and dials its connections.
+func newAdapter(route *router.Route, config *Config) (*Adapter, error) {
+	adapter, err := buildAdapter(route, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := adapter.connect(); err != nil {
+		return nil, err
+	}
+	return adapter, nil
+}
+
+// buildAdapter creates an Adapter for the route with the given config file,
+// leaving its connections to be dialed.
+func buildAdapter(route *router.Route, config *Config) (*Adapter, error) {
+	if logLevelErr != nil {
+		return nil, logLevelErr
+	}
+
+	transportName := route.AdapterTransport("udp")
+	transport, found := router.AdapterTransports.Lookup(transportName)
 	if !found {
 		return nil, errors.New("unable to find adapter: " + route.Adapter)
 	}
 
-	conn, err := transport.Dial(route.Address, route.Options)
+	if err := config.overrideOptions(route.Options); err != nil {
+		return nil, err
+	}
+
+	rules, err := config.compile()
+	if err != nil {
+		return nil, errors.New("logstash: " + err.Error())
+	}
+
+	// Route options take precedence over the config file.
+	options := make(map[string]string)
+	for key, value := range config.Options {
+		options[key] = value
+	}
+	for key, value := range route.Options {
+		options[key] = value
+	}
+
+	address := route.Address
+	if address == "" {
+		address = config.Address
+	}
+
+	if err := validateOptions(options, transportName); err != nil {
+		return nil, err
+	}
+
+	// logspout's own tcp and udp transports can't use a proxy or a forced
+	// IP family, so dial them ourselves.
+	if options["proxy"] != "" || options["ip_family"] != "" {
+		switch transportName {
+		case "tcp":
+			transport = new(tcpTransport)
+		case "udp":
+			transport = new(udpTransport)
+		}
+	}
+
+	ack, err := boolOption(options, "ack", false)
+	if err != nil {
+		return nil, err
+	}
+	if ack {
+		transport = new(ackTransport)
+	}
+
+	queueSize, err := intOption(options, "queue_size", defaultQueueSize)
+	if err != nil {
+		return nil, err
+	}
+
+	backpressure, err := enumOption(options, "backpressure", backpressureDropNewest,
+		backpressureBlock, backpressureDropNewest, backpressureDropOldest)
+	if err != nil {
+		return nil, err
+	}
+
+	sendBuffer, err := intOption(options, "send_buffer", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	keepAlive, err := keepAliveOption(options)
+	if err != nil {
+		return nil, err
+	}
+
+	writeTimeout, err := durationOption(options, "write_timeout", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff, err := newBackoff(options)
+	if err != nil {
+		return nil, err
+	}
+	retryAttempts, err := intOption(options, "retry_attempts", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	configWatch, err := durationOption(options, "config_watch", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	connections, err := intOption(options, "connections", 1)
+	if err != nil {
+		return nil, err
+	}
+	if connections > 1 && transportName == "file" {
+		return nil, errors.New("logstash: the file transport supports only one connection")
+	}
+
+	var messageTemplate *template.Template
+	if text := options["template"]; text != "" {
+		if messageTemplate, err = compileTemplate("template", text); err != nil {
+			return nil, errors.New("logstash: invalid template: " + err.Error())
+		}
+	}
+
+	// The HTTP outputs need @timestamp, so the envelope defaults to on there.
+	if decodingTransports[transportName] && options["envelope"] == "" {
+		options["envelope"] = "true"
+	}
+
+	timestamps, err := newTimestampParser(listOption(options, "timestamp_layouts"))
+	if err != nil {
+		return nil, err
+	}
+
+	if rename := mergeRename(config.Rename, options["rename"]); rename != "" {
+		options["rename"] = rename
+	}
+
+	schema, err := newSchema(options, timestamps != nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := schema.checkFields(rules.fields); err != nil {
+		return nil, err
+	}
+
+	codec, err := newCodec(options, schema)
+	if err != nil {
+		return nil, err
+	}
+	if _, isJSON := codec.(*jsonCodec); !isJSON && decodingTransports[transportName] {
+		return nil, errors.New("logstash: the " + transportName + " transport requires the json codec")
+	}
+	// The HTTP outputs read the built-in fields by name to build their
+	// requests, so the fields must keep their names and place.
+	if schema != nil && decodingTransports[transportName] && (schema.nestDocker || len(schema.rename) > 0 || len(schema.omit) > 0) {
+		return nil, errors.New("logstash: rename, omit and nest_docker are not supported by the " + transportName + " transport")
+	}
+
+	// Syslog messages may span lines, so they are framed by octet counting
+	// over stream connections instead of ending with a newline.
+	lineFraming := streamTransports[transportName] && !ack
+	if syslog, ok := codec.(*syslogCodec); ok && lineFraming {
+		if transportName == "file" {
+			syslog.escapeNewlines = true
+		} else {
+			syslog.octetCounting = true
+			lineFraming = false
+		}
+	}
+
+	parseSyslog, err := boolOption(options, "parse_syslog", false)
+	if err != nil {
+		return nil, err
+	}
+
+	stderrLevel, err := enumOption(options, "stderr_level", "", levels...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Merged events get the multiline tag, any extra tags and the static
+	// tags; the slices are shared by all events and never modified.
+	tags := listOption(options, "tags")
+	multilineTag := options["multiline_tag"]
+	if multilineTag == "" {
+		multilineTag = defaultMultilineTag
+	}
+	mergedTags := append([]string{multilineTag}, listOption(options, "multiline_extra_tags")...)
+	mergedTags = append(mergedTags, tags...)
+
+	// Clip the capacities, so appending to a shared slice always copies it.
+	tags = tags[:len(tags):len(tags)]
+	mergedTags = mergedTags[:len(mergedTags):len(mergedTags)]
+
+	multiline, err := boolOption(options, "multiline", true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !multiline && rules.multilineRule != nil {
+		return nil, errors.New("logstash: multiline=false cannot be combined with multiline_pattern")
+	}
+
+	multilineMaxBuffer, err := intOption(options, "multiline_max_buffer", defaultMultilineMaxBuffer)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Adapter{
-		route: route,
-		conn:  conn,
-	}, nil
+	keepLines, err := boolOption(options, "multiline_keep_lines", false)
+	if err != nil {
+		return nil, err
+	}
+	if _, isJSON := codec.(*jsonCodec); keepLines && !isJSON {
+		return nil, errors.New("logstash: multiline_keep_lines is only supported by the json codec")
+	}
+
+	sequence, err := boolOption(options, "sequence", false)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint, err := boolOption(options, "fingerprint", false)
+	if err != nil {
+		return nil, err
+	}
+
+	ecsMetadata, err := boolOption(options, "ecs_metadata", false)
+	if err != nil {
+		return nil, err
+	}
+	var ecsTask map[string]string
+	if ecsMetadata {
+		// Containers' own ECS labels still work without the endpoint.
+		if ecsTask, err = fetchECSTask(); err != nil {
+			logWarn("logstash_ecs: unable to read task metadata:", err)
+		}
+	}
+
+	joinPartial, err := boolOption(options, "join_partial", true)
+	if err != nil {
+		return nil, err
+	}
+
+	environment := options["environment"]
+	if environment == "" {
+		environment = os.Getenv(environmentEnv)
+	}
+
+	redialAfter, err := intOption(options, "redial_after", defaultRedialAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	maxEventSize, err := intOption(options, "max_event_size", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetter, err := newDeadLetter(options["dead_letter"], backoff, writeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	statsInterval, err := durationOption(options, "stats_interval", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	statsOutput, err := enumOption(options, "stats_output", statsLog, statsLog, statsEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	dockerEvents, err := boolOption(options, "docker_events", false)
+	if err != nil {
+		return nil, err
+	}
+
+	var mirror *Adapter
+	if target := options["mirror"]; target != "" {
+		if mirror, err = newMirror(target, options); err != nil {
+			return nil, err
+		}
+	}
+
+	startupCheck, err := enumOption(options, "startup_check", startupOff, startupOff, startupFail, startupLazy)
+	if err != nil {
+		return nil, err
+	}
+
+	spoolSize, err := intOption(options, "spool_size", defaultSpoolSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each connection gets its own spool so replay keeps its events in order.
+	var spools []*spool
+	if dir := options["spool_dir"]; dir != "" {
+		for i := 0; i < connections; i++ {
+			spool, err := openSpool(filepath.Join(dir, strconv.Itoa(i)), int64(spoolSize))
+			if err != nil {
+				return nil, errors.New("logstash: invalid spool_dir: " + err.Error())
+			}
+			if maxEventSize > 0 {
+				spool.maxRecord = int64(maxEventSize)
+				if lineFraming {
+					// The newline is spooled with the event.
+					spool.maxRecord++
+				}
+			}
+			spools = append(spools, spool)
+		}
+	}
+
+	adapter := &Adapter{
+		route:         route,
+		transport:     transport,
+		address:       address,
+		options:       options,
+		sendBuffer:    sendBuffer,
+		keepAlive:     keepAlive,
+		writeTimeout:  writeTimeout,
+		backoff:       backoff,
+		retryAttempts: retryAttempts,
+		redialAfter:   redialAfter,
+		lineFraming:   lineFraming,
+		queueSize:     queueSize,
+		backpressure:  backpressure,
+		configPath:    os.Getenv(configEnv),
+		configWatch:   configWatch,
+		tags:          tags,
+		mergedTags:    mergedTags,
+		environment:   environment,
+		template:      messageTemplate,
+		parseSyslog:   parseSyslog,
+		stderrLevel:   stderrLevel,
+		multiline:     multiline,
+		keepLines:     keepLines,
+		ecsMetadata:   ecsMetadata,
+		ecsTask:       ecsTask,
+		timestamps:    timestamps,
+		schema:        schema,
+		codec:         codec,
+		eventType:     options["type"],
+		maxEventSize:  maxEventSize,
+		deadLetter:    deadLetter,
+		spools:        spools,
+		statsInterval: statsInterval,
+		statsOutput:   statsOutput,
+		dockerEvents:  dockerEvents,
+		mirror:        mirror,
+		joinPartial:   joinPartial,
+		sequence:      sequence,
+		fingerprint:   fingerprint,
+		startupCheck:  startupCheck,
+	}
+	adapter.rules.Store(rules)
+	if allowlist := listOption(options, "address_allowlist"); len(allowlist) > 0 {
+		adapter.destinations = newDestinations(adapter, allowlist)
+	}
+	adapter.buffers = newBufferBudget(multilineMaxBuffer, &adapter.counters)
+
+	adapter.conns = make([]net.Conn, connections)
+	adapter.pending = make([]chan net.Conn, connections)
+
+	return adapter, nil
+}
+
+// closeConns closes the connections that are open.
+func closeConns(conns []net.Conn) {
+	for _, conn := range conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
 }
 
 // MergeMessages merges an array of Message into a string
 func MergeMessages(messages []Message) string {
-	var strs = make([]string, 0)
+	switch len(messages) {
+	case 0:
+		return ""
+	case 1:
+		return messages[0].Message
+	}
+
+	size := len(messages) - 1
+	for i := range messages {
+		size += len(messages[i].Message)
+	}
 
-	for _, x := range messages {
-		strs = append(strs, x.Message)
+	var merged strings.Builder
+	merged.Grow(size)
+	merged.WriteString(messages[0].Message)
+	for i := range messages[1:] {
+		merged.WriteByte('\n')
+		merged.WriteString(messages[i+1].Message)
 	}
 
-	return strings.Join(strs, "\n")
+	return merged.String()
 }
 
-// GetTags decides if a message array should be tagged multiline.
-func GetTags (messages []Message) []string {
-	var tags = make([]string, 0)
+// multilineTags is returned by GetTags for every merged event.
+var multilineTags = []string{defaultMultilineTag}
 
+// GetTags decides if a message array should be tagged multiline, using the
+// default tag name. Single-line messages get no tags. The returned slice is
+// shared and must not be modified.
+func GetTags(messages []Message) []string {
 	if len(messages) > 1 {
-		tags = append(tags, "multiline")
-	} else {
-		tags = append(tags, "")
+		return multilineTags
 	}
 
-	return tags
+	return nil
 }
 
 // IsMultiline is a function that determines if a string should be in the queue map.
+//
+// Cheap byte checks settle the common cases: indented lines match at once,
+// and lines without any of multilineLiterals can't match, so the regexp only
+// runs at the literals of the few that may.
 func IsMultiline(message string) bool {
-	for _, expression := range regexps {
-		if expression.Match([]byte(message)) == true {
-			return true;
+	if message == "" {
+		return false
+	}
+
+	switch message[0] {
+	case ' ', '\t', '\n', '\f', '\r':
+		return true
+	}
+
+	for start := 0; ; {
+		i := indexMultilineLiteral(message[start:])
+		if i < 0 {
+			return false
+		}
+		if multilineRegexp.MatchString(message[start+i:]) {
+			return true
 		}
+		start += i + 1
 	}
+}
 
-	return false;
+// indexMultilineLiteral returns the index of the first of multilineLiterals
+// in message, or -1 if there is none.
+func indexMultilineLiteral(message string) int {
+	first := -1
+	for _, literal := range multilineLiterals {
+		if i := strings.Index(message, literal); i >= 0 && (first < 0 || i < first) {
+			first = i
+		}
+	}
+	return first
 }
 
 // GetHostname gets the HOSTNAME variable or the container's hostname.
@@ -87,97 +618,94 @@ func GetHostname() string {
 	hostname := os.Getenv("HOSTNAME")
 
 	if hostname == "" {
-		log.Println("logstash: Defaulting to container hostname.")
+		logInfo("logstash: Defaulting to container hostname.")
 		hostname, err := os.Hostname()
 		if err != nil {
-			log.Println("logstash_hostname:", err)
+			logWarn("logstash_hostname:", err)
 		}
 		return hostname
 	}
 	return hostname
 }
 
-// Stream implements the router.LogAdapter interface.
-func (a *Adapter) Stream(logstream chan *router.Message) {
-	queue := make(map[string][]Message)
+// Message is a simple JSON input to Logstash.
+//
+// Fields are flattened into the top-level JSON object.
+type Message struct {
+	Message  string   `json:"message"`
+	Name     string   `json:"container_name"`
+	ID       string   `json:"container_id"`
+	Image    string   `json:"image_name"`
+	Hostname string   `json:"container_hostname"`
+	Host     string   `json:"host"`
+	Stream   string   `json:"stream"`
+	Tags     []string `json:"tags,omitempty"`
+
+	Environment string `json:"environment,omitempty"`
+	Type        string `json:"type,omitempty"`
 
-	hostname := GetHostname()
+	// Sequence numbers a container's events in the order their first line
+	// was read, across stdout and stderr.
+	Sequence uint64 `json:"sequence,omitempty"`
 
-	for m := range logstream {
-		rawMessage := Message{
-			Message:  m.Data,
-		}
-		finalMessage := Message{}
+	// Lines are the original lines of a merged event.
+	Lines     []string `json:"lines,omitempty"`
+	LineCount int      `json:"line_count,omitempty"`
 
-		messages, existing := queue[m.Container.ID];
+	// Fingerprint identifies the event across resends.
+	Fingerprint string `json:"fingerprint,omitempty"`
 
-		// Create an empty slice if there is no queue slice.
-		if !existing {
-			messages = []Message{}
-		}
+	// Destination is the address chosen by the container's label, if any.
+	Destination string `json:"-"`
 
-		if IsMultiline(m.Data) {
-			messages = append(messages, rawMessage)
-			queue[m.Container.ID] = messages;
-			continue
-		} else {
-			if len(queue[m.Container.ID]) == 0 {
-				messages = append(messages, rawMessage)
-				queue[m.Container.ID] = messages;
-				continue
-			} else {
-				// remove trailing slash from container name
-				containerName := strings.TrimLeft(m.Container.Name, "/")
-
-				if len(messages) > 1 {
-					messages = append(messages, rawMessage)
-				}
+	Fields    map[string]string `json:"-"`
+	Timestamp time.Time         `json:"-"`
 
-				finalMessage = Message{
-					Message: MergeMessages(messages),
-					Name: containerName,
-					ID: m.Container.ID,
-					Image: m.Container.Config.Image,
-					Hostname: m.Container.Config.Hostname,
-					Stream: m.Source,
-					Tags: GetTags(messages),
-					Host: hostname,
-				}
-				
-				if len(messages) == 1 && !IsMultiline(messages[0].Message) {
-					messages = []Message{rawMessage}
-				} else {
-					messages = []Message{}
-				}
+	// LogTime is the time extracted from the message, if any.
+	LogTime time.Time `json:"-"`
 
-				queue[m.Container.ID] = messages;
-			}
-		}
+	// ownFields is set once Fields is a private copy that may be modified.
+	ownFields bool
+}
 
-		// Mashal the message into JSON.
-		js, err := json.Marshal(finalMessage)
-		if err != nil {
-			log.Println("logstash_marshal:", err)
-			continue
-		}
+// EventTime is the time extracted from the message, or the time Docker
+// received it.
+func (m *Message) EventTime() time.Time {
+	if !m.LogTime.IsZero() {
+		return m.LogTime
+	}
+	return m.Timestamp
+}
 
-		// Write the message to the Logstash server.
-		_, err = a.conn.Write(js)
-		if err != nil {
-			log.Println("logstash_write:", err)
-			continue
+// setField sets an extra field, copying the shared static fields first.
+func (m *Message) setField(key, value string) {
+	if !m.ownFields {
+		fields := make(map[string]string, len(m.Fields)+1)
+		for k, v := range m.Fields {
+			fields[k] = v
 		}
+		m.Fields = fields
+		m.ownFields = true
 	}
+
+	m.Fields[key] = value
 }
 
-// Message is a simple JSON input to Logstash.
-type Message struct {
-	Message  string   `json:"message"`
-	Name     string   `json:"container_name"`
-	ID       string   `json:"container_id"`
-	Image    string   `json:"image_name"`
-	Hostname string   `json:"container_hostname"`
-	Host     string   `json:"host"`
-	Stream   string   `json:"stream"`
-	Tags     []string `json:"tags"`
+// MarshalJSON implements json.Marshaler.
+func (m *Message) MarshalJSON() ([]byte, error) {
+	type plain Message
+
+	js, err := json.Marshal((*plain)(m))
+	if err != nil || len(m.Fields) == 0 {
+		return js, err
+	}
+
+	fields, err := json.Marshal(m.Fields)
+	if err != nil {
+		return nil, err
+	}
+
+	// Splice the fields object into the message object.
+	js = append(js[:len(js)-1], ',')
+	return append(js, fields[1:]...), nil
 }
@@ -0,0 +1,204 @@
+package logstash
+
+import (
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// legacyMultilineRegexps are the expressions IsMultiline used to try in turn
+// before they were combined.
+var legacyMultilineRegexps = []*regexp.Regexp{
+	regexp.MustCompile(`^\s`),
+	regexp.MustCompile(`line \d+, in .+`),
+	regexp.MustCompile(`Traceback `),
+	regexp.MustCompile(`LINE \d+:`),
+}
+
+func legacyIsMultiline(message string) bool {
+	for _, expression := range legacyMultilineRegexps {
+		if expression.MatchString(message) {
+			return true
+		}
+	}
+	return false
+}
+
+var multilineCases = []struct {
+	message string
+	want    bool
+}{
+	{"", false},
+	{"GET /index.html 200", false},
+	{" indented", true},
+	{"\tindented", true},
+	{"\n", true},
+	{"\r\n", true},
+	{"\f", true},
+	{"\v vertical tab is not \\s", false},
+	{" non-breaking space is not \\s", false},
+	{"x ", false},
+	{"Traceback (most recent call last):", true},
+	{"Traceback", false},
+	{"traceback (lower case)", false},
+	{"no Traceback here: Traceback ", true},
+	{`  File "x.py", line 3, in <module>`, true},
+	{`File "x.py", line 3, in <module>`, true},
+	{"line 3, in main", true},
+	{"line 3, in ", false},
+	{"line , in main", false},
+	{"newline 12, in loop", true},
+	{"line one, then line 3, in main", true},
+	{"LINE one, then LINE 2:", true},
+	{"line 3 in main", false},
+	{"a line here", false},
+	{"LINE 1: SELECT * FROM t", true},
+	{"LINE 1 SELECT", false},
+	{"LINE x:", false},
+	{"ERROR: syntax error at LINE 42:", true},
+	{"line 3, in main\n", true},
+	{"LINE", false},
+	{"line", false},
+}
+
+func TestIsMultiline(t *testing.T) {
+	for _, c := range multilineCases {
+		if got := IsMultiline(c.message); got != c.want {
+			t.Errorf("IsMultiline(%q) = %v, want %v", c.message, got, c.want)
+		}
+		if legacy := legacyIsMultiline(c.message); legacy != c.want {
+			t.Errorf("legacy IsMultiline(%q) = %v, want %v", c.message, legacy, c.want)
+		}
+	}
+}
+
+// TestIsMultilineFragments compares IsMultiline with the legacy regexps on
+// every arrangement of fragments near the prefix boundaries.
+func TestIsMultilineFragments(t *testing.T) {
+	fragments := []string{" ", "\t", "x", "line ", "LINE ", "3", ", in ", ":", "Traceback", " ", "m"}
+
+	var build func(prefix string, depth int)
+	build = func(prefix string, depth int) {
+		if got, want := IsMultiline(prefix), legacyIsMultiline(prefix); got != want {
+			t.Errorf("IsMultiline(%q) = %v, legacy regexps say %v", prefix, got, want)
+		}
+		if depth == 0 {
+			return
+		}
+		for _, fragment := range fragments {
+			build(prefix+fragment, depth-1)
+		}
+	}
+	build("", 4)
+}
+
+func BenchmarkIsMultiline(b *testing.B) {
+	lines := []string{
+		`172.17.0.1 - - [01/May/2024:12:00:00 +0000] "GET /index.html HTTP/1.1" 200 612`,
+		`  File "/app/main.py", line 12, in <module>`,
+		"Traceback (most recent call last):",
+		"2024-05-01 12:00:00,000 INFO worker started on line 4 of the schedule",
+	}
+
+	for _, line := range lines {
+		b.Run("current/"+line[:8], func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				IsMultiline(line)
+			}
+		})
+		b.Run("legacy/"+line[:8], func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				legacyIsMultiline(line)
+			}
+		})
+	}
+}
+
+func TestMergeMessages(t *testing.T) {
+	cases := []struct {
+		lines []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"one"}, "one"},
+		{[]string{"one", "", "three"}, "one\n\nthree"},
+	}
+
+	for _, c := range cases {
+		messages := make([]Message, len(c.lines))
+		for i, line := range c.lines {
+			messages[i].Message = line
+		}
+		if got := MergeMessages(messages); got != c.want {
+			t.Errorf("MergeMessages(%q) = %q, want %q", c.lines, got, c.want)
+		}
+	}
+}
+
+// TestSharedTagsNotModified checks that adding a container's label tags to
+// the shared tag slices copies them.
+func TestSharedTagsNotModified(t *testing.T) {
+	adapter, err := newAdapter(&router.Route{
+		Adapter: "logstash+file",
+		Options: map[string]string{
+			"file_path":            filepath.Join(t.TempDir(), "events.log"),
+			"tags":                 "static",
+			"multiline_extra_tags": "extra",
+		},
+	}, new(Config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeConns(adapter.conns)
+
+	merged := []Message{{Message: "a"}, {Message: "b"}}
+	shared := map[string][]string{
+		"multilineTags": GetTags(merged),
+		"tags":          adapter.eventTags(merged[:1]),
+		"mergedTags":    adapter.eventTags(merged),
+	}
+
+	for name, tags := range shared {
+		before := append([]string(nil), tags...)
+
+		first := withLabelTags(tags, map[string]string{tagsLabel: "first"})
+		second := withLabelTags(tags, map[string]string{tagsLabel: "second"})
+		if cap(tags) != len(tags) {
+			t.Errorf("%s has spare capacity, so appending to it would share storage", name)
+		}
+		if !reflect.DeepEqual(tags, before) {
+			t.Errorf("%s changed from %q to %q", name, before, tags)
+		}
+		if first[len(first)-1] != "first" || second[len(second)-1] != "second" {
+			t.Errorf("%s: label tags share storage: %q, %q", name, first, second)
+		}
+	}
+
+	if !reflect.DeepEqual(multilineTags, []string{defaultMultilineTag}) {
+		t.Errorf("multilineTags = %q", multilineTags)
+	}
+}
+
+func BenchmarkMergeMessages(b *testing.B) {
+	messages := make([]Message, 20)
+	for i := range messages {
+		messages[i].Message = `  File "/usr/lib/python3/site-packages/app/handlers.py", line 120, in handle`
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		MergeMessages(messages)
+	}
+}
+
+func BenchmarkGetTags(b *testing.B) {
+	messages := []Message{{Message: "Traceback (most recent call last):"}, {Message: "  File \"x.py\""}}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		GetTags(messages)
+	}
+}
@@ -0,0 +1,89 @@
+package logstash
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// mirrorExcluded are the options that are not copied to the mirror, because
+// they only make sense once per route.
+var mirrorExcluded = map[string]bool{
+	"mirror":            true,
+	"mirror_codec":      true,
+	"connections":       true,
+	"config_watch":      true,
+	"spool_dir":         true,
+	"spool_size":        true,
+	"dead_letter":       true,
+	"stats_interval":    true,
+	"stats_output":      true,
+	"docker_events":     true,
+	"ecs_metadata":      true,
+	"address_allowlist": true,
+}
+
+// newMirror creates the adapter that every event is additionally written
+// to. target is a URI such as tcp://archive:5000; options that apply to all
+// transports are copied from the route, the target's query parameters are
+// added, and mirror_codec selects its codec.
+func newMirror(target string, options map[string]string) (*Adapter, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("logstash: invalid mirror: " + target)
+	}
+
+	transportName := strings.TrimPrefix(u.Scheme, "logstash+")
+	if transportName == "logstash" {
+		transportName = "udp"
+	}
+
+	mirrorOptions := make(map[string]string)
+	for key, value := range options {
+		if knownOptions[key] == nil && !mirrorExcluded[key] {
+			mirrorOptions[key] = value
+		}
+	}
+	for key, values := range u.Query() {
+		mirrorOptions[key] = values[len(values)-1]
+	}
+	if codec := options["mirror_codec"]; codec != "" {
+		mirrorOptions["codec"] = codec
+	}
+
+	// The config file's options are already part of options, and its
+	// transport-specific ones may not apply to the mirror's transport.
+	adapter, err := newAdapter(&router.Route{
+		Adapter: "logstash+" + transportName,
+		Address: u.Host,
+		Options: mirrorOptions,
+	}, new(Config))
+	if err != nil {
+		return nil, errors.New("logstash: invalid mirror: " + strings.TrimPrefix(err.Error(), "logstash: "))
+	}
+
+	return adapter, nil
+}
+
+// mirrorEvent encodes m with the mirror's codec and queues it, dropping it
+// if the mirror has fallen behind so it never slows down the main output.
+func (a *Adapter) mirrorEvent(m *Message, queue chan<- *encodeBuffer) {
+	buf := bufferPool.Get().(*encodeBuffer)
+
+	if err := a.mirror.codec.encode(buf, m); err != nil {
+		logError("logstash_mirror:", err)
+		buf.release()
+		return
+	}
+
+	select {
+	case queue <- buf:
+	default:
+		dropped := atomic.AddUint64(&a.mirror.counters.droppedNewest, 1)
+		logWarn("logstash_mirror: queue full, dropped event, total:", dropped)
+		buf.release()
+	}
+}
@@ -0,0 +1,278 @@
+package logstash
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// knownOptions lists every route option understood by the adapter, mapped
+// to the transports it is limited to. A nil entry applies to all transports.
+var knownOptions = map[string][]string{
+	"queue_size":           nil,
+	"backpressure":         nil,
+	"connections":          nil,
+	"redial_after":         nil,
+	"write_timeout":        nil,
+	"startup_check":        nil,
+	"backoff_initial":      nil,
+	"backoff_max":          nil,
+	"backoff_multiplier":   nil,
+	"backoff_jitter":       nil,
+	"retry_attempts":       nil,
+	"config_watch":         nil,
+	"max_event_size":       nil,
+	"dead_letter":          nil,
+	"spool_dir":            nil,
+	"spool_size":           nil,
+	"stats_interval":       nil,
+	"stats_output":         nil,
+	"docker_events":        nil,
+	"mirror":               nil,
+	"mirror_codec":         nil,
+	"address_allowlist":    nil,
+	"tags":                 nil,
+	"environment":          nil,
+	"template":             nil,
+	"rename":               nil,
+	"nest_docker":          nil,
+	"omit":                 nil,
+	"type":                 nil,
+	"envelope":             nil,
+	"codec":                nil,
+	"syslog_sd_id":         nil,
+	"parse_syslog":         nil,
+	"stderr_level":         nil,
+	"timestamp_layouts":    nil,
+	"multiline":            nil,
+	"multiline_max_buffer": nil,
+	"join_partial":         nil,
+	"sequence":             nil,
+	"fingerprint":          nil,
+	"ecs_metadata":         nil,
+	"multiline_tag":        nil,
+	"multiline_extra_tags": nil,
+	"multiline_keep_lines": nil,
+	"multiline_pattern":    nil,
+	"multiline_negate":     nil,
+	"multiline_match":      nil,
+	"multiline_timeout":    nil,
+	"send_buffer":          {"udp"},
+	"keepalive":            {"tcp", "tls", "mtls", "ws", "wss", "es", "ess", "otlp", "otlps", "zmq", "dd"},
+	"keepalive_interval":   {"tcp", "tls", "mtls", "ws", "wss", "es", "ess", "otlp", "otlps", "zmq", "dd"},
+	"ws_path":              {"ws", "wss"},
+	"ws_ping_interval":     {"ws", "wss"},
+	"ws_pong_timeout":      {"ws", "wss"},
+	"ack":                  {"tcp"},
+	"ack_window":           {"tcp"},
+	"ack_timeout":          {"tcp"},
+	"ack_flush_interval":   {"tcp"},
+	"es_index":             {"es", "ess"},
+	"es_username":          {"es", "ess"},
+	"es_password":          {"es", "ess"},
+	"es_api_key":           {"es", "ess"},
+	"es_batch_size":        {"es", "ess"},
+	"es_flush_interval":    {"es", "ess"},
+	"otlp_protocol":        {"otlp", "otlps"},
+	"otlp_path":            {"otlp", "otlps"},
+	"otlp_headers":         {"otlp", "otlps"},
+	"otlp_batch_size":      {"otlp", "otlps"},
+	"otlp_flush_interval":  {"otlp", "otlps"},
+	"dd_api_key":           {"dd"},
+	"dd_source":            {"dd"},
+	"dd_tags":              {"dd"},
+	"dd_batch_size":        {"dd"},
+	"dd_flush_interval":    {"dd"},
+	"zmq_socket":           {"zmq"},
+	"zmq_hwm":              {"zmq"},
+	"zmq_topic":            {"zmq"},
+	"file_path":            {"file"},
+	"file_max_size":        {"file"},
+	"file_rotate_interval": {"file"},
+	"file_max_backups":     {"file"},
+	"file_compress":        {"file"},
+	"ip_family":            {"udp", "tcp", "mtls", "ws", "wss", "es", "ess", "otlp", "otlps", "zmq", "dd"},
+	"proxy":                {"tcp", "mtls", "ws", "wss", "es", "ess", "otlp", "otlps", "zmq", "dd"},
+	"proxy_username":       {"tcp", "mtls", "ws", "wss", "es", "ess", "otlp", "otlps", "zmq", "dd"},
+	"proxy_password":       {"tcp", "mtls", "ws", "wss", "es", "ess", "otlp", "otlps", "zmq", "dd"},
+	"tls_ca":               {"mtls", "wss", "ess", "otlps"},
+	"tls_cert":             {"mtls", "wss", "ess", "otlps"},
+	"tls_key":              {"mtls", "wss", "ess", "otlps"},
+	"tls_reload":           {"mtls"},
+}
+
+// validateOptions rejects unknown options and options that do not apply to
+// the route's transport.
+func validateOptions(options map[string]string, transport string) error {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		transports, found := knownOptions[key]
+		if !found {
+			if suggestion := suggestOption(key); suggestion != "" {
+				return fmt.Errorf("logstash: unknown option %q (did you mean %q?)", key, suggestion)
+			}
+			return fmt.Errorf("logstash: unknown option %q", key)
+		}
+
+		if transports == nil {
+			continue
+		}
+
+		supported := false
+		for _, name := range transports {
+			if name == transport {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("logstash: option %q is not supported by the %s transport", key, transport)
+		}
+	}
+
+	return nil
+}
+
+// suggestOption returns the known option closest to key, if any is close
+// enough to be a likely typo.
+func suggestOption(key string) string {
+	best, bestDistance := "", 3
+
+	for option := range knownOptions {
+		if distance := levenshtein(key, option); distance < bestDistance || (distance == bestDistance && option < best) {
+			best, bestDistance = option, distance
+		}
+	}
+
+	return best
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// intOption parses a positive integer option.
+func intOption(options map[string]string, key string, dfault int) (int, error) {
+	value := options[key]
+	if value == "" {
+		return dfault, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("logstash: invalid %s: %q must be a positive integer", key, value)
+	}
+
+	return n, nil
+}
+
+// floatOption parses a number option that must be at least min.
+func floatOption(options map[string]string, key string, dfault, min float64) (float64, error) {
+	value := options[key]
+	if value == "" {
+		return dfault, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < min {
+		return 0, fmt.Errorf("logstash: invalid %s: %q must be a number of at least %g", key, value, min)
+	}
+
+	return f, nil
+}
+
+// boolOption parses a boolean option such as "true" or "0".
+func boolOption(options map[string]string, key string, dfault bool) (bool, error) {
+	value := options[key]
+	if value == "" {
+		return dfault, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("logstash: invalid %s: %q must be true or false", key, value)
+	}
+
+	return b, nil
+}
+
+// durationOption parses a positive duration option such as "30s".
+func durationOption(options map[string]string, key string, dfault time.Duration) (time.Duration, error) {
+	value := options[key]
+	if value == "" {
+		return dfault, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("logstash: invalid %s: %q must be a positive duration", key, value)
+	}
+
+	return d, nil
+}
+
+// enumOption parses an option restricted to a fixed set of values.
+func enumOption(options map[string]string, key string, dfault string, allowed ...string) (string, error) {
+	value := options[key]
+	if value == "" {
+		return dfault, nil
+	}
+
+	for _, candidate := range allowed {
+		if value == candidate {
+			return value, nil
+		}
+	}
+
+	return "", fmt.Errorf("logstash: invalid %s: %q must be one of %v", key, value, allowed)
+}
+
+// listOption parses a comma-separated option, ignoring empty entries.
+func listOption(options map[string]string, key string) []string {
+	var values []string
+
+	for _, value := range strings.Split(options[key], ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
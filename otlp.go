@@ -0,0 +1,434 @@
+package logstash
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+const (
+	defaultOTLPPath      = "/v1/logs"
+	defaultOTLPBatchSize = 500
+	defaultOTLPFlush     = time.Second
+	defaultOTLPTimeout   = 10 * time.Second
+
+	// otlpRetries is how many times a batch is resent after a retryable
+	// response, waiting as set by the backoff options in between.
+	otlpRetries = 5
+
+	// otlpScope names the instrumentation scope of the exported records.
+	otlpScope = "logspout-logstash"
+
+	// otlpGRPCPort is the well-known port of OTLP/gRPC endpoints, which
+	// can't be exported to.
+	otlpGRPCPort = "4317"
+)
+
+func init() {
+	router.AdapterTransports.Register(&otlpTransport{secure: false}, "otlp")
+	router.AdapterTransports.Register(&otlpTransport{secure: true}, "otlps")
+}
+
+// otlpTransport exports events as OpenTelemetry log records with OTLP over
+// HTTP, using the JSON encoding of the protocol.
+type otlpTransport struct {
+	secure bool
+}
+
+// Dial implements the router.AdapterTransport interface.
+func (t *otlpTransport) Dial(addr string, options map[string]string) (net.Conn, error) {
+	if err := checkOTLPProtocol(addr, options); err != nil {
+		return nil, err
+	}
+	batchSize, err := intOption(options, "otlp_batch_size", defaultOTLPBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	flushInterval, err := durationOption(options, "otlp_flush_interval", defaultOTLPFlush)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := parseHeaders(options["otlp_headers"])
+	if err != nil {
+		return nil, err
+	}
+	backoff, err := newBackoff(options)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newHTTPClient(addr, options, t.secure, defaultOTLPTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	path := options["otlp_path"]
+	if path == "" {
+		path = defaultOTLPPath
+	}
+
+	scheme := "http"
+	if t.secure {
+		scheme = "https"
+	}
+
+	e := &otlpExporter{
+		url:     (&url.URL{Scheme: scheme, Host: addr, Path: path}).String(),
+		headers: headers,
+		backoff: backoff,
+		client:  client,
+	}
+
+	c := newBatchConn("logstash_otlp", batchSize, flushInterval, e.export)
+	c.probe = e.check
+	return c, nil
+}
+
+// checkOTLPProtocol refuses routes meant for an OTLP protocol other than
+// OTLP/HTTP with JSON: otlp_protocol, named like the OTEL_EXPORTER_OTLP_PROTOCOL
+// setting, or, when it's unset, an address on the OTLP/gRPC port.
+func checkOTLPProtocol(addr string, options map[string]string) error {
+	switch protocol := options["otlp_protocol"]; protocol {
+	case "http/json":
+	case "":
+		if _, port, err := net.SplitHostPort(addr); err == nil && port == otlpGRPCPort {
+			return errors.New("logstash: invalid otlp address: port " + otlpGRPCPort + " is for OTLP/gRPC, which is not supported; use the OTLP/HTTP port, usually 4318, or set otlp_protocol=http/json")
+		}
+	case "grpc", "http/protobuf":
+		return errors.New("logstash: invalid otlp_protocol: " + protocol + " is not supported, only http/json")
+	default:
+		return errors.New("logstash: invalid otlp_protocol: must be http/json: " + protocol)
+	}
+	return nil
+}
+
+// newHTTPClient builds the client of an HTTP output, dialing through the
+// route's proxy and IP family. write_timeout bounds each request.
+func newHTTPClient(addr string, options map[string]string, secure bool, dfaultTimeout time.Duration) (*http.Client, error) {
+	timeout, err := durationOption(options, "write_timeout", dfaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := newDialer(options)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return d.dial(addr)
+		},
+		MaxIdleConnsPerHost: 1,
+	}
+
+	if secure {
+		if transport.TLSClientConfig, err = newTLSConfig(addr, options); err != nil {
+			return nil, err
+		}
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// parseHeaders parses "Name=value,Name=value" request headers.
+func parseHeaders(value string) (http.Header, error) {
+	headers := make(http.Header)
+
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		equals := strings.Index(pair, "=")
+		if equals <= 0 {
+			return nil, errors.New("logstash: invalid otlp_headers: " + strconv.Quote(pair) + " must be Name=value")
+		}
+		headers.Add(strings.TrimSpace(pair[:equals]), strings.TrimSpace(pair[equals+1:]))
+	}
+
+	return headers, nil
+}
+
+// otlpExporter sends batches of events to an OTLP/HTTP logs endpoint.
+type otlpExporter struct {
+	url     string
+	headers http.Header
+	backoff *backoff
+	client  *http.Client
+}
+
+// otlpResourceKeys maps event fields describing the container to OTel
+// resource attributes. Events are grouped by resource.
+var otlpResourceKeys = map[string]string{
+	"container_name": "container.name",
+	"container_id":   "container.id",
+	"image_name":     "container.image.name",
+	"host":           "host.name",
+}
+
+// otlpSeverities maps the level field to OTel severity numbers.
+var otlpSeverities = map[string]int{
+	"trace":  1,
+	"debug":  5,
+	"info":   9,
+	"notice": 10,
+	"warn":   13,
+	"error":  17,
+	"fatal":  21,
+}
+
+// otlpKeyValue is an OTLP attribute.
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// otlpRecord is an OTLP LogRecord.
+type otlpRecord struct {
+	TimeUnixNano         string                 `json:"timeUnixNano,omitempty"`
+	ObservedTimeUnixNano string                 `json:"observedTimeUnixNano"`
+	SeverityNumber       int                    `json:"severityNumber,omitempty"`
+	SeverityText         string                 `json:"severityText,omitempty"`
+	Body                 map[string]interface{} `json:"body"`
+	Attributes           []otlpKeyValue         `json:"attributes,omitempty"`
+}
+
+// otlpResourceLogs holds the records of one resource.
+type otlpResourceLogs struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+// otlpScopeLogs holds the records of one instrumentation scope.
+type otlpScopeLogs struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	LogRecords []otlpRecord `json:"logRecords"`
+}
+
+// check sends a HEAD request to the logs endpoint.
+func (e *otlpExporter) check() error {
+	req, err := http.NewRequest("HEAD", e.url, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range e.headers {
+		req.Header[name] = values
+	}
+	return checkHTTP(e.client, req)
+}
+
+// export converts the batch to an ExportLogsServiceRequest and sends it,
+// retrying responses the protocol marks as retryable. The batch is sent in
+// one request, so it is delivered or fails as a whole.
+func (e *otlpExporter) export(batch [][]byte) ([][]byte, error) {
+	body, err := otlpRequest(batch, time.Now())
+	if err != nil {
+		return batch, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if attempt > otlpRetries {
+				return batch, errors.New("dropped " + strconv.Itoa(len(batch)) + " events after repeated retryable responses")
+			}
+			time.Sleep(e.backoff.delay(attempt))
+		}
+
+		retry, err := e.post(body)
+		if !retry {
+			if err != nil {
+				return batch, err
+			}
+			return nil, nil
+		}
+		if err != nil {
+			logWarn("logstash_otlp:", err)
+		}
+	}
+}
+
+// post sends one request, reporting whether it should be retried.
+func (e *otlpExporter) post(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for name, values := range e.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		io.Copy(ioutil.Discard, resp.Body)
+		return true, errors.New("export request returned " + resp.Status)
+	default:
+		text, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return false, errors.New("export request failed: " + resp.Status + ": " + string(text))
+	}
+
+	var result struct {
+		PartialSuccess struct {
+			RejectedLogRecords json.Number `json:"rejectedLogRecords"`
+			ErrorMessage       string      `json:"errorMessage"`
+		} `json:"partialSuccess"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&result) == nil {
+		if rejected := result.PartialSuccess.RejectedLogRecords; rejected != "" && rejected != "0" {
+			logError("logstash_otlp:", rejected, "records rejected:", result.PartialSuccess.ErrorMessage)
+		}
+	}
+
+	return false, nil
+}
+
+// otlpRequest builds the JSON ExportLogsServiceRequest for encoded events.
+// Events that can't be decoded are logged and skipped.
+func otlpRequest(batch [][]byte, observed time.Time) ([]byte, error) {
+	var resources []*otlpResourceLogs
+	byResource := make(map[string]*otlpResourceLogs)
+
+	for _, event := range batch {
+		decoder := json.NewDecoder(bytes.NewReader(event))
+		decoder.UseNumber()
+
+		var fields map[string]interface{}
+		if err := decoder.Decode(&fields); err != nil {
+			logError("logstash_otlp: undecodable event:", err)
+			continue
+		}
+
+		resource, key := otlpResource(fields)
+		logs := byResource[key]
+		if logs == nil {
+			logs = &otlpResourceLogs{ScopeLogs: make([]otlpScopeLogs, 1)}
+			logs.Resource.Attributes = resource
+			logs.ScopeLogs[0].Scope.Name = otlpScope
+			byResource[key] = logs
+			resources = append(resources, logs)
+		}
+
+		scope := &logs.ScopeLogs[0]
+		scope.LogRecords = append(scope.LogRecords, otlpLogRecord(fields, observed))
+	}
+
+	return json.Marshal(map[string]interface{}{"resourceLogs": resources})
+}
+
+// otlpResource removes the container metadata from an event's fields and
+// returns it as resource attributes, with a key identifying the resource.
+func otlpResource(fields map[string]interface{}) ([]otlpKeyValue, string) {
+	var attributes []otlpKeyValue
+	var key strings.Builder
+
+	for _, field := range []string{"container_name", "container_id", "image_name", "host"} {
+		value, found := fields[field].(string)
+		if !found {
+			continue
+		}
+		delete(fields, field)
+
+		attributes = append(attributes, otlpKeyValue{otlpResourceKeys[field], otlpValue(value)})
+		if field == "container_name" {
+			attributes = append(attributes, otlpKeyValue{"service.name", otlpValue(value)})
+		}
+
+		key.WriteString(value)
+		key.WriteByte(0)
+	}
+
+	return attributes, key.String()
+}
+
+// otlpLogRecord converts the remaining fields of an event to a LogRecord.
+// The message becomes the body, @timestamp the time and level the
+// severity; all other fields become attributes.
+func otlpLogRecord(fields map[string]interface{}, observed time.Time) otlpRecord {
+	record := otlpRecord{
+		ObservedTimeUnixNano: strconv.FormatInt(observed.UnixNano(), 10),
+		Body:                 otlpValue(fields["message"]),
+	}
+	delete(fields, "message")
+	delete(fields, "@version")
+
+	if text, ok := fields["@timestamp"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, text); err == nil {
+			record.TimeUnixNano = strconv.FormatInt(t.UnixNano(), 10)
+			delete(fields, "@timestamp")
+		}
+	}
+
+	if level, ok := fields["level"].(string); ok {
+		record.SeverityText = level
+		record.SeverityNumber = otlpSeverities[level]
+		delete(fields, "level")
+	}
+
+	record.Attributes = otlpAttributes(fields)
+	return record
+}
+
+// otlpAttributes converts fields to attributes, sorted by key.
+func otlpAttributes(fields map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attributes := make([]otlpKeyValue, 0, len(keys))
+	for _, key := range keys {
+		attributes = append(attributes, otlpKeyValue{key, otlpValue(fields[key])})
+	}
+	return attributes
+}
+
+// otlpValue converts a decoded JSON value to an OTLP AnyValue.
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			// 64-bit integers are encoded as strings in OTLP/JSON.
+			return map[string]interface{}{"intValue": v.String()}
+		}
+		f, _ := v.Float64()
+		return map[string]interface{}{"doubleValue": f}
+	case []interface{}:
+		values := make([]map[string]interface{}, len(v))
+		for i := range v {
+			values[i] = otlpValue(v[i])
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+	case map[string]interface{}:
+		return map[string]interface{}{"kvlistValue": map[string]interface{}{"values": otlpAttributes(v)}}
+	default:
+		return map[string]interface{}{}
+	}
+}
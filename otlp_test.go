@@ -0,0 +1,38 @@
+package logstash
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestOTLPProtocol checks that routes meant for OTLP/gRPC or OTLP/HTTP with
+// protobuf are refused rather than sent JSON they can't read.
+func TestOTLPProtocol(t *testing.T) {
+	cases := []struct {
+		addr     string
+		protocol string
+		want     string
+	}{
+		{"collector:4318", "", ""},
+		{"collector:4318", "http/json", ""},
+		{"collector:4317", "http/json", ""},
+		{"collector:4317", "", "port 4317 is for OTLP/gRPC"},
+		{"collector:4318", "grpc", "grpc is not supported"},
+		{"collector:4318", "http/protobuf", "http/protobuf is not supported"},
+		{"collector:4318", "json", "must be http/json"},
+	}
+
+	for _, c := range cases {
+		options := map[string]string{}
+		if c.protocol != "" {
+			options["otlp_protocol"] = c.protocol
+		}
+		err := checkOTLPProtocol(c.addr, options)
+		if c.want == "" && err != nil {
+			t.Errorf("%s with %q: %v", c.addr, c.protocol, err)
+		}
+		if c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)) {
+			t.Errorf("%s with %q: error = %v, want %q", c.addr, c.protocol, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package logstash
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// parseLabel is the container label holding a regexp whose named captures
+// become fields of its events.
+const parseLabel = "logstash.parse"
+
+// compileParsePatterns compiles the config file's parse patterns. Each must
+// have at least one named capture, and captures may not set reserved fields.
+func compileParsePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled, err := compilePatterns("parse", patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, expression := range compiled {
+		if err := checkCaptures(expression); err != nil {
+			return nil, fmt.Errorf("parse: %v", err)
+		}
+	}
+
+	return compiled, nil
+}
+
+// checkCaptures validates the named captures of a parse pattern.
+func checkCaptures(expression *regexp.Regexp) error {
+	named := 0
+	for _, name := range expression.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		if reservedFields[name] {
+			return fmt.Errorf("%q captures reserved field %q", expression, name)
+		}
+		named++
+	}
+
+	if named == 0 {
+		return fmt.Errorf("%q has no named captures", expression)
+	}
+	return nil
+}
+
+// labelParsePattern compiles a container's logstash.parse label. Invalid
+// patterns are logged and ignored.
+func labelParsePattern(labels map[string]string, id string) *regexp.Regexp {
+	label := strings.TrimSpace(labels[parseLabel])
+	if label == "" {
+		return nil
+	}
+
+	expression, err := regexp.Compile(label)
+	if err == nil {
+		err = checkCaptures(expression)
+	}
+	if err != nil {
+		logWarn("logstash_labels: invalid "+parseLabel+" label on", id+":", err)
+		return nil
+	}
+
+	return expression
+}
+
+// applyParse sets fields from the named captures of the first pattern that
+// matches the event's message, trying the container's label first.
+func applyParse(event *Message, label *regexp.Regexp, patterns []*regexp.Regexp) {
+	if label != nil && parseFields(event, label) {
+		return
+	}
+
+	for _, expression := range patterns {
+		if parseFields(event, expression) {
+			return
+		}
+	}
+}
+
+// parseFields sets the named captures of expression as fields, reporting
+// whether it matched. Groups that didn't take part in the match are skipped.
+func parseFields(event *Message, expression *regexp.Regexp) bool {
+	match := expression.FindStringSubmatchIndex(event.Message)
+	if match == nil {
+		return false
+	}
+
+	for i, name := range expression.SubexpNames() {
+		if name == "" || match[2*i] < 0 {
+			continue
+		}
+		event.setField(name, event.Message[match[2*i]:match[2*i+1]])
+	}
+
+	return true
+}
@@ -0,0 +1,752 @@
+package logstash
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// defaultQueueSize is the capacity of each container's message queue.
+const defaultQueueSize = 1024
+
+// typeLabel is the container label overriding the event type.
+const typeLabel = "logstash.type"
+
+// dockerPartialSize is the size of the pieces Docker splits long lines
+// into. A line of exactly this size is taken to continue in the next one.
+const dockerPartialSize = 16 * 1024
+
+// workerIdleTimeout is how long a container may stay silent before its
+// worker flushes any buffered lines and exits.
+const workerIdleTimeout = 5 * time.Minute
+
+// Stream implements the router.LogAdapter interface.
+//
+// Reading, multiline aggregation, encoding and network writes each run in
+// their own goroutine. Every container stream gets its own bounded queue and
+// aggregation worker, while the encode and send stages are unbuffered so
+// that containers take turns; a container flooding its queue only delays and
+// drops its own messages. Each connection has its own encode and send stage,
+// and containers are sharded across them by ID so their events stay in order.
+func (a *Adapter) Stream(logstream chan *router.Message) {
+	a.hostname = GetHostname()
+
+	stop := a.watchConfig()
+	defer stop()
+
+	shards := make([]chan *Message, len(a.conns))
+
+	// Mirrored events are queued so a slow mirror doesn't hold up the
+	// main output.
+	var mirrored chan *encodeBuffer
+	mirrorDone := make(chan struct{})
+	if a.mirror != nil {
+		mirrored = make(chan *encodeBuffer, a.queueSize)
+		go func() {
+			defer close(mirrorDone)
+			a.mirror.send(0, mirrored)
+		}()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2 * len(shards))
+
+	for i := range a.conns {
+		events := make(chan *Message)
+		encoded := make(chan *encodeBuffer)
+		shards[i] = events
+
+		go func() {
+			defer wg.Done()
+			a.encode(events, encoded, mirrored)
+		}()
+
+		go func(shard int) {
+			defer wg.Done()
+			a.send(shard, encoded)
+		}(i)
+	}
+
+	// Stats and Docker events are sent on the shards too, so they must stop
+	// before the shards are closed.
+	done := make(chan struct{})
+	var producers sync.WaitGroup
+
+	if a.statsInterval > 0 {
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			a.reportStats(shards[0], done)
+		}()
+	}
+
+	if a.dockerEvents {
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			a.watchDocker(shards, done)
+		}()
+	}
+
+	a.read(logstream, shards)
+
+	close(done)
+	producers.Wait()
+
+	for _, events := range shards {
+		close(events)
+	}
+
+	wg.Wait()
+
+	if a.destinations != nil {
+		a.destinations.close()
+	}
+
+	if a.mirror != nil {
+		close(mirrored)
+		<-mirrorDone
+	}
+}
+
+// Backpressure policies applied when a container's queue is full.
+const (
+	backpressureBlock      = "block"
+	backpressureDropNewest = "drop_newest"
+	backpressureDropOldest = "drop_oldest"
+)
+
+// counters tracks pipeline outcomes. Fields are updated atomically.
+type counters struct {
+	received      uint64
+	sent          uint64
+	bytes         uint64
+	failed        uint64
+	reconnects    uint64
+	blocked       uint64
+	droppedNewest uint64
+	droppedOldest uint64
+
+	// buffered is the number of lines currently held by multiline buffers,
+	// and bufferedBytes their size.
+	buffered      int64
+	bufferedBytes int64
+}
+
+// workerKey identifies a container's output stream.
+type workerKey struct {
+	id     string
+	source string
+}
+
+// containerWorker is the queue feeding the aggregator of a single
+// container stream.
+type containerWorker struct {
+	lines    chan queuedLine
+	sequence *sequence
+	lastSeen time.Time
+}
+
+// queuedLine is a log line with its position in the container's output.
+type queuedLine struct {
+	*router.Message
+	seq uint64
+}
+
+// sequence numbers the lines of a container across its stdout and stderr
+// workers, in the order they were read.
+type sequence struct {
+	next    uint64
+	workers int
+}
+
+// read dispatches messages from the log stream to workers per container and stream.
+func (a *Adapter) read(logstream chan *router.Message, shards []chan *Message) {
+	workers := make(map[workerKey]*containerWorker)
+	sequences := make(map[string]*sequence)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	reap := time.NewTicker(workerIdleTimeout / 2)
+	defer reap.Stop()
+
+	for {
+		select {
+		case m, ok := <-logstream:
+			if !ok {
+				for _, worker := range workers {
+					close(worker.lines)
+				}
+				return
+			}
+
+			atomic.AddUint64(&a.counters.received, 1)
+
+			// stdout and stderr are buffered separately so interleaved
+			// lines from the two streams are never merged together.
+			key := workerKey{m.Container.ID, m.Source}
+
+			worker, found := workers[key]
+			if !found {
+				seq := sequences[m.Container.ID]
+				if seq == nil {
+					seq = new(sequence)
+					sequences[m.Container.ID] = seq
+				}
+				seq.workers++
+
+				worker = &containerWorker{
+					lines:    make(chan queuedLine, a.queueSize),
+					sequence: seq,
+				}
+				workers[key] = worker
+
+				events := shards[shardFor(m.Container.ID, len(shards))]
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					a.aggregate(worker.lines, events)
+				}()
+			}
+			worker.lastSeen = time.Now()
+
+			worker.sequence.next++
+			a.enqueue(worker, queuedLine{m, worker.sequence.next})
+
+		case <-reap.C:
+			for id, worker := range workers {
+				if len(worker.lines) == 0 && time.Since(worker.lastSeen) > workerIdleTimeout {
+					close(worker.lines)
+					delete(workers, id)
+
+					if worker.sequence.workers--; worker.sequence.workers == 0 {
+						delete(sequences, id.id)
+					}
+				}
+			}
+		}
+	}
+}
+
+// enqueue adds m to the worker's queue, applying the backpressure policy
+// when the queue is full.
+func (a *Adapter) enqueue(worker *containerWorker, m queuedLine) {
+	select {
+	case worker.lines <- m:
+		return
+	default:
+	}
+
+	switch a.backpressure {
+	case backpressureBlock:
+		atomic.AddUint64(&a.counters.blocked, 1)
+		worker.lines <- m
+	case backpressureDropOldest:
+		select {
+		case <-worker.lines:
+			dropped := atomic.AddUint64(&a.counters.droppedOldest, 1)
+			logWarn("logstash: queue full, dropped oldest message from", m.Container.ID, "total:", dropped)
+		default:
+		}
+		// read is the only sender, so there is room now.
+		worker.lines <- m
+	default:
+		dropped := atomic.AddUint64(&a.counters.droppedNewest, 1)
+		logWarn("logstash: queue full, dropped message from", m.Container.ID, "total:", dropped)
+	}
+}
+
+// aggregate merges multiline messages from a single container stream into events.
+func (a *Adapter) aggregate(lines <-chan queuedLine, events chan<- *Message) {
+	g := &aggregator{
+		adapter:  a,
+		events:   events,
+		timer:    time.NewTimer(time.Hour),
+		flushNow: make(chan struct{}, 1),
+	}
+	g.timer.Stop()
+
+	defer g.track()
+
+	for {
+		g.track()
+
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				// Flush whatever is still buffered once the container goes quiet.
+				if m := g.takePartial(); m != nil {
+					g.add(m, a.loadRules())
+				}
+				g.flush(a.loadRules())
+				return
+			}
+
+			m := line.Message
+			g.seq = line.seq
+
+			if m.Container.Config.Tty {
+				m = normalizeTTY(m)
+			}
+
+			if a.joinPartial {
+				if m = g.joinPartial(m); m == nil {
+					continue
+				}
+			}
+
+			// Rules may be swapped by a reload at any time.
+			g.add(m, a.loadRules())
+
+		case <-g.timer.C:
+			g.flush(a.loadRules())
+
+		case <-g.flushNow:
+			// The multiline buffers are over their memory limit.
+			rules := a.loadRules()
+			if m := g.takePartial(); m != nil {
+				g.add(m, rules)
+			}
+			g.flush(rules)
+		}
+	}
+}
+
+// add applies the filters and the multiline mode to a line.
+func (g *aggregator) add(m *router.Message, rules *rules) {
+	if !rules.accept(m.Data) {
+		return
+	}
+
+	if !g.adapter.multiline {
+		g.addSingle(m, rules)
+	} else if rules.multilineRule != nil {
+		g.addPattern(m, rules)
+	} else {
+		g.addLegacy(m, rules)
+	}
+}
+
+// ttyStream is the stream of containers with a TTY, which merges stdout
+// and stderr.
+const ttyStream = "tty"
+
+// normalizeTTY cleans up a line from a container with a TTY: the terminal's
+// CRLF line ending is removed, and text overwritten after a carriage return,
+// such as a progress bar redrawing itself, is dropped as a terminal would.
+// Messages are shared between routes, so a copy is returned.
+func normalizeTTY(m *router.Message) *router.Message {
+	normalized := *m
+	normalized.Source = ttyStream
+
+	data := strings.TrimRight(m.Data, "\r")
+	if i := strings.LastIndexByte(data, '\r'); i >= 0 {
+		data = data[i+1:]
+	}
+	normalized.Data = data
+
+	return &normalized
+}
+
+// joinPartial reassembles lines Docker split into dockerPartialSize pieces.
+// It returns nil while a split line is incomplete.
+func (g *aggregator) joinPartial(m *router.Message) *router.Message {
+	if len(m.Data) == dockerPartialSize {
+		if g.partial == nil {
+			g.partial = m
+			g.partialSeq = g.seq
+			g.partialData = append(g.partialData[:0], m.Data...)
+		} else {
+			g.partialData = append(g.partialData, m.Data...)
+		}
+		return nil
+	}
+
+	if g.partial == nil {
+		return m
+	}
+
+	joined := *g.partial
+	joined.Data = string(g.partialData) + m.Data
+	g.partial = nil
+	g.seq = g.partialSeq
+	return &joined
+}
+
+// takePartial returns the pieces of a split line received so far, if any.
+func (g *aggregator) takePartial() *router.Message {
+	if g.partial == nil {
+		return nil
+	}
+
+	joined := *g.partial
+	joined.Data = string(g.partialData)
+	g.partial = nil
+	g.seq = g.partialSeq
+	return &joined
+}
+
+// aggregator holds the multiline state of a single container stream.
+type aggregator struct {
+	adapter  *Adapter
+	events   chan<- *Message
+	messages []Message
+	last     *router.Message
+	timer    *time.Timer
+
+	// size is the number of bytes in messages. buffered and bufferedBytes
+	// are the lines and bytes, including partialData, last reported.
+	size          int
+	buffered      int
+	bufferedBytes int
+
+	// flushNow asks the aggregator to flush because the buffers of all
+	// streams together are over the multiline_max_buffer limit.
+	flushNow chan struct{}
+
+	// seq is the sequence number of the line being added.
+	seq uint64
+
+	// partial is the first piece of a line split by Docker, and
+	// partialData the pieces received so far.
+	partial     *router.Message
+	partialSeq  uint64
+	partialData []byte
+
+	// labelFields, labelParse and destination are read from the
+	// container's labels once; fields merges labelFields with the static fields of fieldsRules.
+	labelFields map[string]string
+	labelParse  *regexp.Regexp
+	destination string
+	parsed      bool
+	fields      map[string]string
+	fieldsRules *rules
+}
+
+// loadLabels reads the container's logstash.fields, logstash.parse and
+// logstash.address labels the first time they are needed.
+func (g *aggregator) loadLabels(m *router.Message) {
+	if g.parsed {
+		return
+	}
+
+	g.labelFields = g.adapter.containerLabelFields(m.Container.Config.Labels, m.Container.ID)
+	g.labelParse = labelParsePattern(m.Container.Config.Labels, m.Container.ID)
+	g.destination = g.adapter.labelDestination(m.Container.Config.Labels, m.Container.ID)
+	g.parsed = true
+}
+
+// eventFields returns the static fields merged with the container's label
+// fields. The merged map is shared by events until the rules are reloaded.
+func (g *aggregator) eventFields(m *router.Message, rules *rules) map[string]string {
+	g.loadLabels(m)
+
+	if len(g.labelFields) == 0 {
+		return rules.fields
+	}
+
+	if g.fieldsRules != rules {
+		g.fields = mergeFields(rules.fields, g.labelFields)
+		g.fieldsRules = rules
+	}
+	return g.fields
+}
+
+// newEvent builds an event from the buffered messages.
+func (g *aggregator) newEvent(m *router.Message, messages []Message, rules *rules) *Message {
+	fields := g.eventFields(m, rules)
+	event := g.adapter.newEvent(m, messages, rules, fields, g.labelParse)
+	event.Destination = g.destination
+	return event
+}
+
+// track updates the multiline buffer counters and the memory budget after
+// lines were added or flushed.
+func (g *aggregator) track() {
+	if delta := len(g.messages) - g.buffered; delta != 0 {
+		atomic.AddInt64(&g.adapter.counters.buffered, int64(delta))
+		g.buffered = len(g.messages)
+	}
+
+	size := g.size
+	if g.partial != nil {
+		size += len(g.partialData)
+	}
+	if size != g.bufferedBytes {
+		g.adapter.buffers.update(g, size)
+		g.bufferedBytes = size
+	}
+}
+
+// flush emits the buffered lines as one event.
+func (g *aggregator) flush(rules *rules) {
+	if len(g.messages) == 0 {
+		return
+	}
+
+	g.events <- g.newEvent(g.last, g.messages, rules)
+
+	// The merged text has been copied out, so the slice can be reused.
+	g.messages = g.messages[:0]
+	g.size = 0
+}
+
+// rawMessage wraps the line being added.
+func (g *aggregator) rawMessage(m *router.Message) Message {
+	return Message{
+		Message:   m.Data,
+		Timestamp: m.Time,
+		Sequence:  g.seq,
+	}
+}
+
+// addSingle emits every line as its own event without buffering.
+func (g *aggregator) addSingle(m *router.Message, rules *rules) {
+	g.messages = append(g.messages[:0], g.rawMessage(m))
+	g.last = m
+	g.flush(rules)
+}
+
+// addLegacy applies the built-in continuation model: a line is held until
+// the next one arrives, and continuation lines are joined to it.
+func (g *aggregator) addLegacy(m *router.Message, rules *rules) {
+	rawMessage := g.rawMessage(m)
+
+	messages := g.messages
+	g.last = m
+
+	if rules.isMultiline(m.Data) || len(messages) == 0 {
+		g.messages = append(messages, rawMessage)
+		g.size += len(m.Data)
+		return
+	}
+
+	if len(messages) > 1 {
+		messages = append(messages, rawMessage)
+	}
+
+	g.events <- g.newEvent(m, messages, rules)
+
+	// The merged text has been copied out, so the slice can be reused.
+	if len(messages) == 1 && !rules.isMultiline(messages[0].Message) {
+		messages = append(messages[:0], rawMessage)
+		g.size = len(m.Data)
+	} else {
+		messages = messages[:0]
+		g.size = 0
+	}
+
+	g.messages = messages
+}
+
+// addPattern applies Filebeat's pattern, negate and match semantics.
+func (g *aggregator) addPattern(m *router.Message, rules *rules) {
+	rule := rules.multilineRule
+	rawMessage := g.rawMessage(m)
+
+	if rule.before {
+		// Continuation lines are held until the line that ends the event.
+		g.messages = append(g.messages, rawMessage)
+		g.size += len(m.Data)
+		g.last = m
+		if !rule.continues(m.Data) {
+			g.flush(rules)
+		}
+	} else {
+		// A line that doesn't continue the buffered event starts a new one.
+		if !rule.continues(m.Data) {
+			g.flush(rules)
+		}
+		g.messages = append(g.messages, rawMessage)
+		g.size += len(m.Data)
+		g.last = m
+	}
+
+	if !g.timer.Stop() {
+		select {
+		case <-g.timer.C:
+		default:
+		}
+	}
+	if len(g.messages) > 0 {
+		g.timer.Reset(rule.timeout)
+	}
+}
+
+// eventTags returns the tags for an event built from messages.
+func (a *Adapter) eventTags(messages []Message) []string {
+	if len(messages) > 1 {
+		return a.mergedTags
+	}
+	return a.tags
+}
+
+// newEvent builds a pooled event from the buffered messages of m's container,
+// with the given extra fields. labelParse is the container's parse pattern,
+// if it has one.
+func (a *Adapter) newEvent(m *router.Message, messages []Message, rules *rules, fields map[string]string, labelParse *regexp.Regexp) *Message {
+	// remove trailing slash from container name
+	containerName := strings.TrimLeft(m.Container.Name, "/")
+
+	event := messagePool.Get().(*Message)
+	*event = Message{
+		Message:  MergeMessages(messages),
+		Name:     containerName,
+		ID:       m.Container.ID,
+		Image:    m.Container.Config.Image,
+		Hostname: m.Container.Config.Hostname,
+		Stream:   m.Source,
+		Tags:     withLabelTags(a.eventTags(messages), m.Container.Config.Labels),
+		Host:     a.hostname,
+
+		Environment: a.environment,
+		Type:        a.eventType,
+		Fields:      fields,
+		Timestamp:   messages[0].Timestamp,
+	}
+
+	if a.sequence {
+		event.Sequence = messages[0].Sequence
+	}
+
+	if a.fingerprint {
+		event.Fingerprint = fingerprint(event)
+	}
+
+	if a.keepLines && len(messages) > 1 {
+		event.Lines = make([]string, len(messages))
+		for i := range messages {
+			event.Lines[i] = messages[i].Message
+		}
+		event.LineCount = len(messages)
+	}
+
+	// The container's label overrides the route's type.
+	if eventType := m.Container.Config.Labels[typeLabel]; eventType != "" {
+		event.Type = eventType
+	}
+
+	if a.timestamps != nil {
+		if t, ok := a.timestamps.parse(event.Message); ok {
+			event.LogTime = t
+		}
+	}
+
+	if a.parseSyslog {
+		applySyslog(event)
+	}
+
+	if labelParse != nil || len(rules.parse) > 0 {
+		applyParse(event, labelParse, rules.parse)
+	}
+
+	if a.stderrLevel != "" {
+		a.applyStderrLevel(event)
+	}
+
+	a.applyTemplates(event, rules)
+
+	return event
+}
+
+// fingerprint returns the SHA-1 of the event's container ID, stream, Docker
+// timestamp and message, before parsing and templates, so the same log line
+// read again after a restart gets the same fingerprint.
+func fingerprint(event *Message) string {
+	hash := sha1.New()
+	hash.Write([]byte(event.ID))
+	hash.Write([]byte{0})
+	hash.Write([]byte(event.Stream))
+	hash.Write([]byte{0})
+	hash.Write([]byte(event.Timestamp.UTC().Format(time.RFC3339Nano)))
+	hash.Write([]byte{0})
+	hash.Write([]byte(event.Message))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// encode marshals events into pooled buffers using the route's codec, and
+// queues them for the mirror if there is one. Events of containers whose
+// label selects another address are queued for its adapter instead.
+func (a *Adapter) encode(events <-chan *Message, encoded, mirrored chan<- *encodeBuffer) {
+	defer close(encoded)
+
+	for message := range events {
+		if a.mirror != nil {
+			a.mirrorEvent(message, mirrored)
+		}
+
+		buf := bufferPool.Get().(*encodeBuffer)
+
+		err := a.codec.encode(buf, message)
+		if err != nil {
+			logError("logstash_marshal:", err)
+			atomic.AddUint64(&a.counters.failed, 1)
+			a.deadLetter.write(deadLetterMarshal, err, message, nil)
+		} else if a.maxEventSize > 0 && buf.Len() > a.maxEventSize {
+			err = fmt.Errorf("event is %d bytes, limit is %d", buf.Len(), a.maxEventSize)
+			logWarn("logstash: dropped event from", message.ID+":", err)
+			atomic.AddUint64(&a.counters.failed, 1)
+			a.deadLetter.write(deadLetterSize, err, message, buf.Bytes())
+		}
+
+		queue := encoded
+		if message.Destination != "" && err == nil {
+			if queue = a.destinations.queue(message.Destination, message.ID); queue == nil {
+				err = errors.New("unable to send to " + message.Destination)
+				atomic.AddUint64(&a.counters.failed, 1)
+				a.deadLetter.write(deadLetterNoServer, err, message, buf.Bytes())
+			}
+		}
+
+		*message = Message{}
+		messagePool.Put(message)
+
+		if err != nil {
+			buf.release()
+			continue
+		}
+
+		queue <- buf
+	}
+}
+
+// shardFor picks the connection that carries a container's events.
+func shardFor(id string, count int) int {
+	if count == 1 {
+		return 0
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(id))
+	return int(hash.Sum32() % uint32(count))
+}
+
+// send writes encoded events to the Logstash server over one connection.
+func (a *Adapter) send(shard int, encoded <-chan *encodeBuffer) {
+	sender := &sender{adapter: a, shard: shard}
+	if a.spools != nil {
+		sender.spool = a.spools[shard]
+	}
+	if a.pending != nil {
+		sender.pending = a.pending[shard]
+	}
+
+	for buf := range encoded {
+		if a.lineFraming {
+			buf.WriteByte('\n')
+		}
+		sender.write(buf.Bytes())
+		buf.release()
+	}
+}
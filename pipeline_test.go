@@ -0,0 +1,242 @@
+package logstash
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+)
+
+// pipelineAdapter builds an adapter writing to a file, with the given
+// route options.
+func pipelineAdapter(t *testing.T, options map[string]string) *Adapter {
+	options["file_path"] = filepath.Join(t.TempDir(), "events.log")
+	adapter, err := newAdapter(&router.Route{Adapter: "logstash+file", Options: options}, new(Config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeConns(adapter.conns) })
+	return adapter
+}
+
+// logLine is a line of a container's output.
+func logLine(id, source, data string) *router.Message {
+	return &router.Message{
+		Container: &docker.Container{ID: id, Name: "/" + id, Config: &docker.Config{}},
+		Source:    source,
+		Data:      data,
+		Time:      time.Now(),
+	}
+}
+
+// aggregateLines reads lines through the adapter's aggregators and returns
+// the events they emitted, as "stream: message" strings in the order they
+// were emitted.
+func aggregateLines(a *Adapter, lines []*router.Message) []string {
+	logstream := make(chan *router.Message)
+	shards := []chan *Message{make(chan *Message)}
+
+	done := make(chan []string)
+	go func() {
+		var events []string
+		for event := range shards[0] {
+			events = append(events, event.Stream+": "+event.Message)
+		}
+		done <- events
+	}()
+
+	go func() {
+		for _, line := range lines {
+			logstream <- line
+		}
+		close(logstream)
+	}()
+	a.read(logstream, shards)
+	close(shards[0])
+
+	return <-done
+}
+
+func TestMultilinePattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		negate  string
+		match   string
+		lines   []string
+		want    []string
+	}{
+		{
+			pattern: `^\s`, match: "after",
+			lines: []string{"one", "  two", "  three", "four"},
+			want:  []string{"stdout: one\n  two\n  three", "stdout: four"},
+		},
+		{
+			pattern: `^\[`, negate: "true", match: "after",
+			lines: []string{"[1] start", "more", "[2] next", "[3] last", "tail"},
+			want:  []string{"stdout: [1] start\nmore", "stdout: [2] next", "stdout: [3] last\ntail"},
+		},
+		{
+			pattern: `\\$`, match: "before",
+			lines: []string{`one \`, `two \`, "three", "four"},
+			want:  []string{"stdout: one \\\ntwo \\\nthree", "stdout: four"},
+		},
+		{
+			pattern: `;$`, negate: "true", match: "before",
+			lines: []string{"one", "two;", "three;"},
+			want:  []string{"stdout: one\ntwo;", "stdout: three;"},
+		},
+	}
+
+	for _, c := range cases {
+		a := pipelineAdapter(t, map[string]string{
+			"multiline_pattern": c.pattern,
+			"multiline_negate":  c.negate,
+			"multiline_match":   c.match,
+		})
+		var lines []*router.Message
+		for _, line := range c.lines {
+			lines = append(lines, logLine("abc", "stdout", line))
+		}
+
+		if got := aggregateLines(a, lines); strings.Join(got, "|") != strings.Join(c.want, "|") {
+			t.Errorf("pattern %q, negate %q, match %s: events %q, want %q", c.pattern, c.negate, c.match, got, c.want)
+		}
+	}
+}
+
+// TestMultilinePerStream checks that lines are buffered per container and
+// stream, so interleaved output is never merged across them.
+func TestMultilinePerStream(t *testing.T) {
+	a := pipelineAdapter(t, map[string]string{"multiline_pattern": `^\s`})
+
+	got := aggregateLines(a, []*router.Message{
+		logLine("abc", "stdout", "out"),
+		logLine("abc", "stderr", "err"),
+		logLine("def", "stdout", "other"),
+		logLine("abc", "stdout", "  out continued"),
+		logLine("abc", "stderr", "  err continued"),
+		logLine("def", "stdout", "  other continued"),
+	})
+	sort.Strings(got)
+
+	want := []string{
+		"stderr: err\n  err continued",
+		"stdout: other\n  other continued",
+		"stdout: out\n  out continued",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("events %q, want %q", got, want)
+	}
+}
+
+// TestJoinPartial checks that lines Docker split into 16KB pieces are
+// reassembled before multiline detection.
+func TestJoinPartial(t *testing.T) {
+	first := strings.Repeat("x", dockerPartialSize)
+	second := strings.Repeat("y", dockerPartialSize)
+
+	cases := []struct {
+		joinPartial string
+		want        []string
+	}{
+		{"true", []string{"stdout: " + first + second + "end", "stdout: next"}},
+		{"false", []string{"stdout: " + first, "stdout: " + second, "stdout: end", "stdout: next"}},
+	}
+
+	for _, c := range cases {
+		a := pipelineAdapter(t, map[string]string{"multiline": "false", "join_partial": c.joinPartial})
+		got := aggregateLines(a, []*router.Message{
+			logLine("abc", "stdout", first),
+			logLine("abc", "stdout", second),
+			logLine("abc", "stdout", "end"),
+			logLine("abc", "stdout", "next"),
+		})
+		if strings.Join(got, "|") != strings.Join(c.want, "|") {
+			t.Errorf("join_partial=%s: got %d events, want %d", c.joinPartial, len(got), len(c.want))
+		}
+	}
+
+	// A split line still incomplete when the stream ends is flushed as is.
+	a := pipelineAdapter(t, map[string]string{"multiline": "false"})
+	if got := aggregateLines(a, []*router.Message{logLine("abc", "stdout", first)}); len(got) != 1 || got[0] != "stdout: "+first {
+		t.Errorf("incomplete split line: got %d events", len(got))
+	}
+}
+
+func TestNormalizeTTY(t *testing.T) {
+	cases := []struct {
+		data string
+		want string
+	}{
+		{"plain\r", "plain"},
+		{"no ending", "no ending"},
+		{"10%\r50%\r100%\r", "100%"},
+		{"line\r\r", "line"},
+		{"\r", ""},
+	}
+
+	for _, c := range cases {
+		m := logLine("abc", "stdout", c.data)
+		m.Container.Config.Tty = true
+
+		got := normalizeTTY(m)
+		if got.Data != c.want || got.Source != ttyStream {
+			t.Errorf("normalizeTTY(%q) = %q on %s, want %q on %s", c.data, got.Data, got.Source, c.want, ttyStream)
+		}
+		if m.Data != c.data {
+			t.Errorf("normalizeTTY(%q) modified the shared message", c.data)
+		}
+	}
+
+	// Lines are normalized before multiline detection.
+	a := pipelineAdapter(t, map[string]string{"multiline_pattern": `^\s`})
+	var lines []*router.Message
+	for _, data := range []string{"start\r", "  10%\r  more\r", "next\r"} {
+		m := logLine("abc", "stdout", data)
+		m.Container.Config.Tty = true
+		lines = append(lines, m)
+	}
+	got := aggregateLines(a, lines)
+	if want := "tty: start\n  more|tty: next"; strings.Join(got, "|") != want {
+		t.Errorf("events %q, want %q", got, want)
+	}
+}
+
+// TestMultilineTimeout checks that a pattern-based event is flushed after
+// multiline_timeout without new lines, without waiting for the stream to
+// end.
+func TestMultilineTimeout(t *testing.T) {
+	a := pipelineAdapter(t, map[string]string{"multiline_pattern": `^\s`, "multiline_timeout": "20ms"})
+
+	logstream := make(chan *router.Message)
+	shards := []chan *Message{make(chan *Message, 1)}
+	read := make(chan struct{})
+	go func() {
+		a.read(logstream, shards)
+		close(read)
+	}()
+	defer func() {
+		close(logstream)
+		<-read
+	}()
+
+	start := time.Now()
+	logstream <- logLine("abc", "stdout", "one")
+	logstream <- logLine("abc", "stdout", "  two")
+
+	select {
+	case event := <-shards[0]:
+		if event.Message != "one\n  two" {
+			t.Errorf("flushed %q", event.Message)
+		}
+		if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+			t.Errorf("flushed after %v, before multiline_timeout", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("buffered event not flushed after multiline_timeout")
+	}
+}
@@ -0,0 +1,268 @@
+package logstash
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// socksRequest is what a fake SOCKS5 proxy received.
+type socksRequest struct {
+	method   byte
+	username string
+	password string
+	target   string
+}
+
+// socksProxy accepts one connection and answers the handshake, replying
+// with the given authentication and connect status codes and a bound address
+// of type atyp. After a successful handshake it echoes the tunnel.
+func socksProxy(t *testing.T, auth, status, atyp byte) (net.Listener, <-chan socksRequest) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := make(chan socksRequest, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		var request socksRequest
+		greeting := make([]byte, 3)
+		if _, err := io.ReadFull(conn, greeting); err != nil || greeting[0] != 0x05 || greeting[1] != 1 {
+			t.Errorf("unexpected greeting % x: %v", greeting, err)
+			return
+		}
+		request.method = greeting[2]
+		conn.Write([]byte{0x05, request.method})
+
+		if request.method == 0x02 {
+			version := make([]byte, 1)
+			io.ReadFull(conn, version)
+			request.username = readSocksString(conn)
+			request.password = readSocksString(conn)
+			conn.Write([]byte{0x01, auth})
+			if auth != 0x00 {
+				return
+			}
+		}
+
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil || header[0] != 0x05 || header[1] != 0x01 {
+			t.Errorf("unexpected request % x: %v", header, err)
+			return
+		}
+		var host string
+		switch header[3] {
+		case 0x01:
+			ip := make([]byte, net.IPv4len)
+			io.ReadFull(conn, ip)
+			host = net.IP(ip).String()
+		case 0x04:
+			ip := make([]byte, net.IPv6len)
+			io.ReadFull(conn, ip)
+			host = net.IP(ip).String()
+		case 0x03:
+			host = readSocksString(conn)
+		}
+		port := make([]byte, 2)
+		io.ReadFull(conn, port)
+		request.target = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+		requests <- request
+
+		reply := []byte{0x05, status, 0x00, atyp}
+		switch atyp {
+		case 0x01:
+			reply = append(reply, 10, 0, 0, 1)
+		case 0x04:
+			reply = append(reply, net.ParseIP("fd00::1")...)
+		case 0x03:
+			reply = append(reply, byte(len("proxy.example")))
+			reply = append(reply, "proxy.example"...)
+		}
+		conn.Write(append(reply, 0x13, 0x88))
+		if status == 0x00 {
+			io.Copy(conn, conn)
+		}
+	}()
+
+	return ln, requests
+}
+
+// readSocksString reads a field prefixed with its length in one byte.
+func readSocksString(conn net.Conn) string {
+	length := make([]byte, 1)
+	io.ReadFull(conn, length)
+	value := make([]byte, length[0])
+	io.ReadFull(conn, value)
+	return string(value)
+}
+
+// checkTunnel checks that bytes written to conn come back through the
+// echoing proxy.
+func checkTunnel(t *testing.T, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("event\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "event\n" {
+		t.Errorf("tunnel returned %q, %v", line, err)
+	}
+}
+
+func TestSOCKS5RoundTrip(t *testing.T) {
+	cases := []struct {
+		proxy  string
+		target string
+		atyp   byte
+		want   socksRequest
+	}{
+		{"socks5://%s", "logstash.example:5000", 0x01, socksRequest{method: 0x00, target: "logstash.example:5000"}},
+		{"socks5://user:secret@%s", "10.1.2.3:5044", 0x04, socksRequest{method: 0x02, username: "user", password: "secret", target: "10.1.2.3:5044"}},
+		{"socks5://%s", "[2001:db8::5]:443", 0x03, socksRequest{method: 0x00, target: "[2001:db8::5]:443"}},
+	}
+
+	for _, c := range cases {
+		ln, requests := socksProxy(t, 0x00, 0x00, c.atyp)
+
+		d, err := newDialer(map[string]string{"proxy": strings.Replace(c.proxy, "%s", ln.Addr().String(), 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := d.dial(c.target)
+		if err != nil {
+			t.Errorf("dial(%q) through %s: %v", c.target, c.proxy, err)
+			ln.Close()
+			continue
+		}
+
+		if got := <-requests; got != c.want {
+			t.Errorf("dial(%q): proxy received %+v, want %+v", c.target, got, c.want)
+		}
+		checkTunnel(t, conn)
+		conn.Close()
+		ln.Close()
+	}
+}
+
+func TestSOCKS5Failures(t *testing.T) {
+	cases := []struct {
+		proxy        string
+		auth, status byte
+		want         string
+	}{
+		{"socks5://user:wrong@%s", 0x01, 0x00, "authentication failed"},
+		{"socks5://%s", 0x00, 0x05, "connect failed with code 5"},
+	}
+
+	for _, c := range cases {
+		ln, _ := socksProxy(t, c.auth, c.status, 0x01)
+
+		d, err := newDialer(map[string]string{"proxy": strings.Replace(c.proxy, "%s", ln.Addr().String(), 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.dial("logstash.example:5000"); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: dial error = %v, want %q", c.proxy, err, c.want)
+		}
+		ln.Close()
+	}
+}
+
+// connectProxy accepts one CONNECT request and answers with status. On
+// success it sends early bytes from the target with the response, then
+// echoes the tunnel.
+func connectProxy(t *testing.T, status int) (net.Listener, <-chan *http.Request) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		reader := bufio.NewReader(conn)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		requests <- req
+
+		if status != http.StatusOK {
+			conn.Write([]byte("HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\nContent-Length: 0\r\n\r\n"))
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhello\n"))
+		io.Copy(conn, reader)
+	}()
+
+	return ln, requests
+}
+
+func TestHTTPConnectRoundTrip(t *testing.T) {
+	ln, requests := connectProxy(t, http.StatusOK)
+	defer ln.Close()
+
+	d, err := newDialer(map[string]string{
+		"proxy":          "http://user:old@" + ln.Addr().String(),
+		"proxy_password": "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.dial("logstash.example:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := <-requests
+	credentials := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	if req.Method != "CONNECT" || req.Host != "logstash.example:5000" || req.Header.Get("Proxy-Authorization") != credentials {
+		t.Errorf("unexpected request %s %s %v", req.Method, req.Host, req.Header)
+	}
+
+	// Bytes sent by the target with the response aren't lost.
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	if line, err := reader.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Errorf("read %q, %v, want the bytes after the response", line, err)
+	}
+	conn.Write([]byte("event\n"))
+	if line, err := reader.ReadString('\n'); err != nil || line != "event\n" {
+		t.Errorf("tunnel returned %q, %v", line, err)
+	}
+}
+
+func TestHTTPConnectRefused(t *testing.T) {
+	ln, _ := connectProxy(t, http.StatusProxyAuthRequired)
+	defer ln.Close()
+
+	d, err := newDialer(map[string]string{"proxy": "http://" + ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.dial("logstash.example:5000"); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("dial error = %v, want the proxy's status", err)
+	}
+}
@@ -0,0 +1,95 @@
+package logstash
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// loadRules returns the rules currently in effect.
+func (a *Adapter) loadRules() *rules {
+	return a.rules.Load().(*rules)
+}
+
+// reloadConfig re-reads the config file and swaps in its rules. The old
+// rules stay in effect if the file is invalid. Options and the address are
+// only read at startup and are not reloaded.
+func (a *Adapter) reloadConfig() {
+	config, err := LoadConfig(a.configPath)
+	if err != nil {
+		logError("logstash_reload:", err)
+		return
+	}
+
+	if err := config.overrideOptions(a.route.Options); err != nil {
+		logError("logstash_reload:", err)
+		return
+	}
+
+	rules, err := config.compile()
+	if err != nil {
+		logError("logstash_reload:", err)
+		return
+	}
+	if err := a.schema.checkFields(rules.fields); err != nil {
+		logError("logstash_reload:", err)
+		return
+	}
+
+	a.rules.Store(rules)
+	logInfo("logstash: reloaded", a.configPath)
+}
+
+// watchConfig reloads the config file on SIGHUP and, when config_watch is
+// set, whenever the file's modification time changes. The returned function
+// stops watching.
+func (a *Adapter) watchConfig() func() {
+	if a.configPath == "" {
+		return func() {}
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	done := make(chan struct{})
+	go func() {
+		var tick <-chan time.Time
+		if a.configWatch > 0 {
+			ticker := time.NewTicker(a.configWatch)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		modified := modTime(a.configPath)
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-hangup:
+				a.reloadConfig()
+				modified = modTime(a.configPath)
+			case <-tick:
+				if current := modTime(a.configPath); !current.Equal(modified) {
+					modified = current
+					a.reloadConfig()
+				}
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(hangup)
+		close(done)
+	}
+}
+
+// modTime returns the modification time of path, or the zero time.
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
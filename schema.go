@@ -0,0 +1,360 @@
+package logstash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// timestampLayout is the ISO8601 layout Logstash uses for @timestamp.
+const timestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// field is a single key and value of an encoded event.
+type field struct {
+	key   string
+	value interface{}
+}
+
+// document is a JSON object that keeps its keys in order.
+type document []field
+
+// MarshalJSON implements json.Marshaler.
+func (d document) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+
+	for i, f := range d {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, err := json.Marshal(f.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// document returns the message's fields in the order they are encoded.
+func (m *Message) document() document {
+	doc := make(document, 0, 10+len(m.Fields))
+	doc = append(doc,
+		field{"message", m.Message},
+		field{"container_name", m.Name},
+		field{"container_id", m.ID},
+		field{"image_name", m.Image},
+		field{"container_hostname", m.Hostname},
+		field{"host", m.Host},
+		field{"stream", m.Stream},
+	)
+
+	if len(m.Tags) > 0 {
+		doc = append(doc, field{"tags", m.Tags})
+	}
+	if m.Environment != "" {
+		doc = append(doc, field{"environment", m.Environment})
+	}
+	if m.Type != "" {
+		doc = append(doc, field{"type", m.Type})
+	}
+	if m.Sequence != 0 {
+		doc = append(doc, field{"sequence", m.Sequence})
+	}
+	if len(m.Lines) > 0 {
+		doc = append(doc, field{"lines", m.Lines}, field{"line_count", m.LineCount})
+	}
+	if m.Fingerprint != "" {
+		doc = append(doc, field{"fingerprint", m.Fingerprint})
+	}
+
+	keys := make([]string, 0, len(m.Fields))
+	for key := range m.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		doc = append(doc, field{key, m.Fields[key]})
+	}
+
+	return doc
+}
+
+// dockerFields maps the container metadata keys to their names when
+// nested under a "docker" object.
+var dockerFields = map[string]string{
+	"container_name":     "name",
+	"container_id":       "id",
+	"image_name":         "image",
+	"container_hostname": "hostname",
+}
+
+// omittableFields are the built-in fields the omit option may drop.
+var omittableFields = map[string]bool{
+	"container_name":     true,
+	"container_id":       true,
+	"image_name":         true,
+	"container_hostname": true,
+	"host":               true,
+	"stream":             true,
+	"tags":               true,
+	"environment":        true,
+	"type":               true,
+}
+
+// schema reshapes events before they are encoded. A nil schema leaves the
+// default layout untouched.
+//
+// Omitted fields are dropped first, container metadata is nested next and
+// top-level keys are renamed last, so the "docker" object itself may be
+// renamed.
+type schema struct {
+	envelope   bool
+	timestamps bool
+	nestDocker bool
+	omit       map[string]bool
+	rename     map[string]string
+
+	// taken are the rename targets that aren't renamed away themselves.
+	// Label and parsed fields with these names are dropped, as they would
+	// duplicate the renamed field's key.
+	taken map[string]bool
+}
+
+// newSchema builds a schema from the route options, or returns nil when no
+// reshaping is configured. With timestamps set, events carry the extracted
+// time as @timestamp and the Docker time as docker_timestamp.
+func newSchema(options map[string]string, timestamps bool) (*schema, error) {
+	rename, err := parseRename(options["rename"])
+	if err != nil {
+		return nil, err
+	}
+
+	nestDocker, err := boolOption(options, "nest_docker", false)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope, err := boolOption(options, "envelope", false)
+	if err != nil {
+		return nil, err
+	}
+
+	omit := make(map[string]bool)
+	for _, key := range listOption(options, "omit") {
+		if !omittableFields[key] {
+			return nil, fmt.Errorf("logstash: invalid omit: %q is not an optional field", key)
+		}
+		if _, renamed := rename[key]; renamed {
+			return nil, fmt.Errorf("logstash: invalid omit: %q is also renamed", key)
+		}
+		omit[key] = true
+	}
+
+	if nestDocker {
+		for from := range rename {
+			if _, nested := dockerFields[from]; nested {
+				return nil, fmt.Errorf("logstash: invalid rename: %q is nested under docker by nest_docker", from)
+			}
+		}
+	}
+
+	if len(rename) == 0 && len(omit) == 0 && !nestDocker && !envelope && !timestamps {
+		return nil, nil
+	}
+
+	taken := make(map[string]bool)
+	for _, to := range rename {
+		if _, renamed := rename[to]; !renamed {
+			taken[to] = true
+		}
+	}
+
+	return &schema{
+		envelope:   envelope,
+		timestamps: timestamps,
+		nestDocker: nestDocker,
+		omit:       omit,
+		rename:     rename,
+		taken:      taken,
+	}, nil
+}
+
+// checkFields refuses static fields that a field is renamed to. s may be
+// nil.
+func (s *schema) checkFields(fields map[string]string) error {
+	if s == nil {
+		return nil
+	}
+
+	for from, to := range s.rename {
+		if _, found := fields[to]; found && s.taken[to] {
+			return fmt.Errorf("logstash: invalid rename: %q would collide with the static field %q", from, to)
+		}
+	}
+	return nil
+}
+
+// mergeRename adds the config file's rename mapping to the route's rename
+// option, whose entries take precedence.
+func mergeRename(config map[string]string, option string) string {
+	if len(config) == 0 {
+		return option
+	}
+
+	routeFields := make(map[string]bool)
+	for _, pair := range strings.Split(option, ",") {
+		if parts := strings.SplitN(pair, ":", 2); len(parts) == 2 {
+			routeFields[strings.TrimSpace(parts[0])] = true
+		}
+	}
+
+	froms := make([]string, 0, len(config))
+	for from := range config {
+		if !routeFields[from] {
+			froms = append(froms, from)
+		}
+	}
+	sort.Strings(froms)
+
+	pairs := make([]string, 0, len(froms)+1)
+	for _, from := range froms {
+		pairs = append(pairs, from+":"+config[from])
+	}
+	if option != "" {
+		pairs = append(pairs, option)
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// parseRename parses a "from:to,from:to" mapping of field names.
+func parseRename(value string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	rename := make(map[string]string)
+	targets := make(map[string]string)
+
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("logstash: invalid rename: %q must be from:to", pair)
+		}
+
+		from, to := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("logstash: invalid rename: %q must be from:to", pair)
+		}
+		if _, found := rename[from]; found {
+			return nil, fmt.Errorf("logstash: invalid rename: %q is renamed twice", from)
+		}
+		if other, found := targets[to]; found {
+			return nil, fmt.Errorf("logstash: invalid rename: %q and %q both renamed to %q", other, from, to)
+		}
+
+		rename[from] = to
+		targets[to] = from
+	}
+
+	// A field may only take the name of a built-in field that is itself
+	// renamed away.
+	for to, from := range targets {
+		if _, renamed := rename[to]; reservedFields[to] && !renamed {
+			return nil, fmt.Errorf("logstash: invalid rename: %q would collide with %q", from, to)
+		}
+	}
+
+	return rename, nil
+}
+
+// apply builds the reshaped document for a message.
+func (s *schema) apply(m *Message) document {
+	doc := m.document()
+
+	if len(s.omit) > 0 {
+		kept := doc[:0]
+		for _, f := range doc {
+			if !s.omit[f.key] {
+				kept = append(kept, f)
+			}
+		}
+		doc = kept
+	}
+
+	if s.timestamps {
+		doc = append(doc, field{"docker_timestamp", m.Timestamp.UTC().Format(timestampLayout)})
+	}
+
+	if s.envelope {
+		doc = append(document{
+			{"@timestamp", m.EventTime().UTC().Format(timestampLayout)},
+			{"@version", "1"},
+		}, doc...)
+	} else if s.timestamps {
+		doc = append(document{
+			{"@timestamp", m.EventTime().UTC().Format(timestampLayout)},
+		}, doc...)
+	}
+
+	if s.nestDocker {
+		doc = nestDocker(doc)
+	}
+
+	if len(s.rename) > 0 {
+		renamed := doc[:0]
+		for _, f := range doc {
+			if to, found := s.rename[f.key]; found {
+				f.key = to
+			} else if s.taken[f.key] {
+				continue
+			}
+			renamed = append(renamed, f)
+		}
+		doc = renamed
+	}
+
+	return doc
+}
+
+// nestDocker moves the container metadata into a "docker" object, placed
+// where the first of those fields was.
+func nestDocker(doc document) document {
+	nested := make(document, 0, len(dockerFields))
+	out := doc[:0]
+	position := -1
+
+	for _, f := range doc {
+		name, found := dockerFields[f.key]
+		if !found {
+			out = append(out, f)
+			continue
+		}
+
+		if position < 0 {
+			position = len(out)
+			out = append(out, field{key: "docker"})
+		}
+		nested = append(nested, field{name, f.value})
+	}
+
+	if position >= 0 {
+		out[position].value = nested
+	}
+
+	return out
+}
@@ -0,0 +1,75 @@
+package logstash
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// TestRenameStaticFieldCollision checks that a field can't be renamed to
+// the name of a static field unless that field is renamed too.
+func TestRenameStaticFieldCollision(t *testing.T) {
+	cases := []struct {
+		rename string
+		want   string
+	}{
+		{"message:log", `"message" would collide with the static field "log"`},
+		{"message:log,log:app_log", ""},
+		{"message:text", ""},
+	}
+
+	for _, c := range cases {
+		adapter, err := newAdapter(&router.Route{
+			Adapter: "logstash+file",
+			Options: map[string]string{
+				"file_path": filepath.Join(t.TempDir(), "events.log"),
+				"rename":    c.rename,
+			},
+		}, &Config{Fields: map[string]string{"log": "static"}})
+		if err == nil {
+			closeConns(adapter.conns)
+		}
+
+		if c.want == "" && err != nil {
+			t.Errorf("rename=%s: %v", c.rename, err)
+		}
+		if c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)) {
+			t.Errorf("rename=%s: error = %v, want %q", c.rename, err, c.want)
+		}
+	}
+}
+
+// TestRenameDropsCollidingFields checks that label and parsed fields named
+// like a rename target don't duplicate its key.
+func TestRenameDropsCollidingFields(t *testing.T) {
+	cases := []struct {
+		rename string
+		want   map[string]interface{}
+	}{
+		{"message:log", map[string]interface{}{"log": "text"}},
+		{"message:log,log:label_log", map[string]interface{}{"log": "text", "label_log": "label"}},
+	}
+
+	for _, c := range cases {
+		s, err := newSchema(map[string]string{"rename": c.rename}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		doc := s.apply(&Message{Message: "text", Fields: map[string]string{"log": "label"}})
+		counts := make(map[string]int)
+		values := make(map[string]interface{})
+		for _, f := range doc {
+			counts[f.key]++
+			values[f.key] = f.value
+		}
+
+		for key, want := range c.want {
+			if counts[key] != 1 || values[key] != want {
+				t.Errorf("rename=%s: %d %q keys, with %v, want one with %v", c.rename, counts[key], key, values[key], want)
+			}
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package logstash
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultSpoolSize is the default limit on the total size of a spool.
+const defaultSpoolSize = 64 << 20
+
+// spoolSegments is how many segments a full spool is split into; the oldest
+// segment is evicted when the spool is full.
+const spoolSegments = 8
+
+// spoolExt is the file extension of spool segments.
+const spoolExt = ".spool"
+
+// spool is a bounded on-disk queue of encoded events, kept while a
+// connection is down and replayed in order once it is back. Events are
+// stored as length-prefixed records in numbered segment files, so spooled
+// events survive a restart. It is only used by one sender goroutine.
+type spool struct {
+	dir         string
+	maxSize     int64
+	segmentSize int64
+	segments    []int
+	sizes       map[int]int64
+	size        int64
+	writer      *os.File
+	readOffset  int64
+
+	// maxRecord, if set, is the size of the largest event spooled. Longer
+	// records found on replay are taken as corrupt.
+	maxRecord int64
+}
+
+// openSpool opens the spool in dir, picking up segments left by a previous
+// run.
+func openSpool(dir string, maxSize int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: maxSize / spoolSegments,
+		sizes:       make(map[int]int64),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, spoolExt) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, spoolExt))
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, id)
+		s.sizes[id] = file.Size()
+		s.size += file.Size()
+	}
+	sort.Ints(s.segments)
+
+	if len(s.segments) > 0 {
+		logInfo("logstash_spool: replaying", s.size, "bytes spooled in", dir)
+	}
+
+	return s, nil
+}
+
+// path returns the file name of a segment.
+func (s *spool) path(id int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d%s", id, spoolExt))
+}
+
+// empty reports whether there are events waiting to be replayed.
+func (s *spool) empty() bool {
+	return len(s.segments) == 0
+}
+
+// append adds an event to the end of the spool, starting a new segment when
+// the current one is full and evicting the oldest when the spool is.
+func (s *spool) append(p []byte) error {
+	record := int64(4 + len(p))
+
+	if s.writer == nil || s.sizes[s.tail()] > 0 && s.sizes[s.tail()]+record > s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	for s.size+record > s.maxSize && len(s.segments) > 1 {
+		s.evict()
+	}
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(p)))
+	if _, err := s.writer.Write(append(length[:], p...)); err != nil {
+		return err
+	}
+
+	s.sizes[s.tail()] += record
+	s.size += record
+	return nil
+}
+
+// tail returns the newest segment.
+func (s *spool) tail() int {
+	if len(s.segments) == 0 {
+		return 0
+	}
+	return s.segments[len(s.segments)-1]
+}
+
+// rotate starts a new segment.
+func (s *spool) rotate() error {
+	if s.writer != nil {
+		s.writer.Close()
+	}
+
+	id := s.tail() + 1
+	file, err := os.OpenFile(s.path(id), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		s.writer = nil
+		return err
+	}
+
+	s.writer = file
+	s.segments = append(s.segments, id)
+	s.sizes[id] = 0
+	return nil
+}
+
+// evict deletes the oldest segment to make room.
+func (s *spool) evict() {
+	id := s.segments[0]
+
+	logWarn("logstash_spool: spool full, discarding", s.sizes[id], "bytes of the oldest events")
+	s.remove(id)
+}
+
+// remove deletes a segment that has been replayed or evicted.
+func (s *spool) remove(id int) {
+	if id == s.tail() && s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+
+	os.Remove(s.path(id))
+	s.size -= s.sizes[id]
+	delete(s.sizes, id)
+	s.segments = s.segments[1:]
+	s.readOffset = 0
+}
+
+// replay writes the spooled events in order until the spool is empty or
+// write fails. Events are removed from the spool as they are written.
+func (s *spool) replay(write func([]byte) error) error {
+	for !s.empty() {
+		id := s.segments[0]
+
+		file, err := os.Open(s.path(id))
+		if err != nil {
+			logError("logstash_spool:", err)
+			s.remove(id)
+			continue
+		}
+
+		if _, err := file.Seek(s.readOffset, io.SeekStart); err != nil {
+			file.Close()
+			return err
+		}
+
+		err = s.replaySegment(id, bufio.NewReader(file), write)
+		file.Close()
+		if err != nil {
+			return err
+		}
+
+		s.remove(id)
+	}
+
+	return nil
+}
+
+// replaySegment writes the remaining records of the oldest segment. A
+// record whose length can't be right ends the segment, as the records after
+// it can't be found.
+func (s *spool) replaySegment(id int, reader *bufio.Reader, write func([]byte) error) error {
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(reader, length[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// A record cut short by a crash ends the segment.
+				return nil
+			}
+			return err
+		}
+
+		size := int64(binary.BigEndian.Uint32(length[:]))
+		if size > s.sizes[id]-s.readOffset-4 || s.maxRecord > 0 && size > s.maxRecord {
+			logError("logstash_spool: corrupt record of", size, "bytes in", s.path(id)+", discarding the rest of the segment")
+			return nil
+		}
+
+		record := make([]byte, size)
+		if _, err := io.ReadFull(reader, record); err != nil {
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if err := write(record); err != nil {
+			return err
+		}
+		s.readOffset += int64(4 + len(record))
+	}
+}
@@ -0,0 +1,222 @@
+package logstash
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// replayAll replays s, returning the events written.
+func replayAll(t *testing.T, s *spool) []string {
+	var events []string
+	if err := s.replay(func(p []byte) error {
+		events = append(events, string(p))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func spoolEvents(n int) []string {
+	var events []string
+	for i := 0; i < n; i++ {
+		events = append(events, "event "+strconv.Itoa(i))
+	}
+	return events
+}
+
+func TestSpoolRoundTrip(t *testing.T) {
+	s, err := openSpool(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []string{"one", "", strings.Repeat("x", 70000), "last"}
+	for _, event := range events {
+		if err := s.append([]byte(event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each record is the event's length as 4 big-endian bytes, then the
+	// event.
+	data, err := ioutil.ReadFile(s.path(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\x00\x00\x00\x03one\x00\x00\x00\x00\x00\x01\x11\x70"; len(data) < len(want) || string(data[:len(want)]) != want {
+		t.Errorf("segment starts % x, want % x", data[:len(want)], want)
+	}
+
+	if got := replayAll(t, s); strings.Join(got, "|") != strings.Join(events, "|") {
+		t.Errorf("replayed %d events, want %d in order", len(got), len(events))
+	}
+	if !s.empty() || s.size != 0 {
+		t.Errorf("spool holds %d bytes in %v after replay", s.size, s.segments)
+	}
+	if files, _ := ioutil.ReadDir(s.dir); len(files) != 0 {
+		t.Errorf("%d segment files left after replay", len(files))
+	}
+}
+
+// TestSpoolReopen checks that events spooled by a previous run are
+// replayed before new ones.
+func TestSpoolReopen(t *testing.T) {
+	dir := t.TempDir()
+	events := spoolEvents(50)
+
+	s, err := openSpool(dir, 800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, event := range events[:30] {
+		s.append([]byte(event))
+		size += int64(4 + len(event))
+	}
+	segments := len(s.segments)
+	s.writer.Close()
+
+	s, err = openSpool(dir, 800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.segments) != segments || s.size != size {
+		t.Errorf("reopened %v holding %d bytes, want %d segments of %d bytes", s.segments, s.size, segments, size)
+	}
+	for _, event := range events[30:] {
+		s.append([]byte(event))
+	}
+
+	if got := replayAll(t, s); strings.Join(got, "|") != strings.Join(events, "|") {
+		t.Errorf("replayed %q, want %q", got, events)
+	}
+}
+
+// TestSpoolResume checks that a replay interrupted by a failed write
+// resumes with that event.
+func TestSpoolResume(t *testing.T) {
+	s, err := openSpool(t.TempDir(), 800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := spoolEvents(20)
+	for _, event := range events {
+		s.append([]byte(event))
+	}
+
+	var got []string
+	for _, failAt := range []int{3, 12} {
+		err := s.replay(func(p []byte) error {
+			if len(got) == failAt {
+				return errConnectionDown
+			}
+			got = append(got, string(p))
+			return nil
+		})
+		if err != errConnectionDown {
+			t.Errorf("replay error = %v, want the write's", err)
+		}
+	}
+	got = append(got, replayAll(t, s)...)
+
+	if strings.Join(got, "|") != strings.Join(events, "|") {
+		t.Errorf("replayed %q, want each event once in order", got)
+	}
+}
+
+// TestSpoolEviction checks that a full spool discards its oldest segments
+// and keeps the newest events in order.
+func TestSpoolEviction(t *testing.T) {
+	s, err := openSpool(t.TempDir(), 800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := spoolEvents(200)
+	for _, event := range events {
+		if err := s.append([]byte(event)); err != nil {
+			t.Fatal(err)
+		}
+		if s.size > s.maxSize {
+			t.Fatalf("spool grew to %d bytes, past %d", s.size, s.maxSize)
+		}
+	}
+
+	got := replayAll(t, s)
+	if len(got) < 50 || strings.Join(got, "|") != strings.Join(events[len(events)-len(got):], "|") {
+		t.Errorf("replayed %q, want the newest events in order", got)
+	}
+}
+
+// TestSpoolTruncated checks that a record cut short by a crash ends its
+// segment without failing the replay.
+func TestSpoolTruncated(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.append([]byte("one"))
+	s.append([]byte("two"))
+	s.writer.Write([]byte("\x00\x00\x00\x10cut"))
+	s.writer.Close()
+
+	if err := ioutil.WriteFile(s.path(2), []byte("\x00\x00\x00\x05three"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := replayAll(t, s); strings.Join(got, "|") != "one|two|three" {
+		t.Errorf("replayed %q", got)
+	}
+	if _, err := os.Stat(s.path(1)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("replayed segment not removed: %v", err)
+	}
+}
+
+// TestSpoolCorruptLength checks that a record whose length is past the end
+// of its segment, or longer than any spooled event, discards the rest of
+// the segment and the replay goes on with the next one.
+func TestSpoolCorruptLength(t *testing.T) {
+	cases := []struct {
+		header    string
+		maxRecord int64
+	}{
+		{"\xff\xff\xff\xf0", 0},
+		{"\x00\x00\x00\x08", 4},
+	}
+
+	for _, c := range cases {
+		dir := t.TempDir()
+		s, err := openSpool(dir, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.append([]byte("one"))
+		s.writer.Write([]byte(c.header + "garbage!\x00\x00\x00\x04lost"))
+		s.writer.Close()
+
+		if err := ioutil.WriteFile(s.path(2), []byte("\x00\x00\x00\x03two"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err = openSpool(dir, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.maxRecord = c.maxRecord
+		if got := replayAll(t, s); strings.Join(got, "|") != "one|two" {
+			t.Errorf("header % x, max record %d: replayed %q", c.header, c.maxRecord, got)
+		}
+		if !s.empty() {
+			t.Errorf("header % x: segments %v left after replay", c.header, s.segments)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package logstash
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Modes of the startup_check option.
+const (
+	startupOff  = "off"
+	startupFail = "fail"
+	startupLazy = "lazy"
+)
+
+// udpProbeTimeout is how long a UDP probe waits for the peer to refuse it.
+const udpProbeTimeout = 500 * time.Millisecond
+
+// checker is implemented by connections that don't reach their endpoint
+// when dialed, such as the HTTP outputs, to verify it.
+type checker interface {
+	check() error
+}
+
+// dialChecked dials a connection and, unless mode is off, verifies that it
+// reaches the endpoint. Dial errors are then reported as failed checks.
+func (a *Adapter) dialChecked(mode string) (net.Conn, error) {
+	conn, err := a.dial()
+	if mode == startupOff {
+		return conn, err
+	}
+
+	if err == nil {
+		if err = checkConn(conn); err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		return nil, errors.New("startup check of " + a.address + " failed: " + err.Error())
+	}
+	return conn, nil
+}
+
+// connect dials the adapter's connections, failing if one can't be dialed
+// or, with startup_check=fail, fails its check.
+func (a *Adapter) connect() error {
+	for i := range a.conns {
+		if err := a.connectShard(i); err != nil {
+			closeConns(a.conns)
+			if a.mirror != nil {
+				closeConns(a.mirror.conns)
+			}
+			if a.startupCheck == startupFail {
+				return errors.New("logstash: " + err.Error())
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// connectShard dials connection i. With startup_check=lazy, a connection
+// that fails its check is dialed in the background instead.
+func (a *Adapter) connectShard(i int) error {
+	conn, err := a.dialChecked(a.startupCheck)
+	if err != nil && a.startupCheck == startupLazy {
+		logWarn("logstash_startup:", err, "- connecting in the background")
+		a.pending[i] = make(chan net.Conn, 1)
+		go a.dialInBackground(a.pending[i])
+		return nil
+	}
+	a.conns[i] = conn
+	return err
+}
+
+// dialInBackground dials a connection that failed its startup check until
+// it succeeds, waiting as set by the backoff options, and hands it to the
+// connection's sender.
+func (a *Adapter) dialInBackground(pending chan<- net.Conn) {
+	for failures := 1; ; failures++ {
+		time.Sleep(a.backoff.delay(failures))
+
+		conn, err := a.dialChecked(startupLazy)
+		if err != nil {
+			logWarn("logstash_startup:", err)
+			continue
+		}
+
+		logInfo("logstash: connected to", a.address)
+		pending <- conn
+		return
+	}
+}
+
+// checkConn verifies a freshly dialed connection. Stream connections are
+// verified by dialing them. UDP has no handshake, so a probe checks that
+// the peer doesn't refuse datagrams.
+func checkConn(conn net.Conn) error {
+	switch c := conn.(type) {
+	case checker:
+		return c.check()
+	case *net.UDPConn:
+		return probeUDP(c)
+	}
+	return nil
+}
+
+// probeUDP sends an empty datagram, which Logstash's udp input ignores, and
+// waits briefly for the ICMP port unreachable the kernel reports as a
+// refused read. No answer means the port is open or filtered.
+func probeUDP(conn *net.UDPConn) error {
+	if _, err := conn.Write(nil); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(udpProbeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var buf [1]byte
+	if _, err := conn.Read(buf[:]); err != nil && !isTimeout(err) {
+		return err
+	}
+	return nil
+}
+
+// checkHTTP sends req, normally a HEAD request, and fails if the endpoint
+// can't be reached or rejects its credentials. Any other response, even an
+// error status, shows the endpoint is there.
+func checkHTTP(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errors.New(req.URL.Host + " rejected the credentials: " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package logstash
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Destinations for the periodic stats selected with the stats_output option.
+const (
+	statsLog   = "log"
+	statsEvent = "event"
+)
+
+// statsType is the type of the stats events sent to Logstash.
+const statsType = "logspout_stats"
+
+// stats is a snapshot of the adapter's counters.
+type stats struct {
+	received      uint64
+	sent          uint64
+	bytes         uint64
+	failed        uint64
+	reconnects    uint64
+	blocked       uint64
+	droppedNewest uint64
+	droppedOldest uint64
+	buffered      int64
+	bufferedBytes int64
+}
+
+// snapshot reads the counters.
+func (c *counters) snapshot() stats {
+	return stats{
+		received:      atomic.LoadUint64(&c.received),
+		sent:          atomic.LoadUint64(&c.sent),
+		bytes:         atomic.LoadUint64(&c.bytes),
+		failed:        atomic.LoadUint64(&c.failed),
+		reconnects:    atomic.LoadUint64(&c.reconnects),
+		blocked:       atomic.LoadUint64(&c.blocked),
+		droppedNewest: atomic.LoadUint64(&c.droppedNewest),
+		droppedOldest: atomic.LoadUint64(&c.droppedOldest),
+		buffered:      atomic.LoadInt64(&c.buffered),
+		bufferedBytes: atomic.LoadInt64(&c.bufferedBytes),
+	}
+}
+
+// fields returns the stats as event fields. Counts are totals since the
+// adapter started, except buffered and buffered_bytes, which are the lines
+// and bytes currently held by multiline buffers.
+func (s stats) fields() map[string]string {
+	return map[string]string{
+		"received":       strconv.FormatUint(s.received, 10),
+		"sent":           strconv.FormatUint(s.sent, 10),
+		"bytes":          strconv.FormatUint(s.bytes, 10),
+		"failed":         strconv.FormatUint(s.failed, 10),
+		"reconnects":     strconv.FormatUint(s.reconnects, 10),
+		"blocked":        strconv.FormatUint(s.blocked, 10),
+		"dropped":        strconv.FormatUint(s.droppedNewest+s.droppedOldest, 10),
+		"dropped_newest": strconv.FormatUint(s.droppedNewest, 10),
+		"dropped_oldest": strconv.FormatUint(s.droppedOldest, 10),
+		"buffered":       strconv.FormatInt(s.buffered, 10),
+		"buffered_bytes": strconv.FormatInt(s.bufferedBytes, 10),
+	}
+}
+
+// String formats the stats for the log.
+func (s stats) String() string {
+	return fmt.Sprintf("received=%d sent=%d bytes=%d failed=%d reconnects=%d blocked=%d dropped_newest=%d dropped_oldest=%d buffered=%d buffered_bytes=%d",
+		s.received, s.sent, s.bytes, s.failed, s.reconnects, s.blocked, s.droppedNewest, s.droppedOldest, s.buffered, s.bufferedBytes)
+}
+
+// reportStats logs the stats or sends them as an event every statsInterval
+// until done is closed.
+func (a *Adapter) reportStats(events chan<- *Message, done <-chan struct{}) {
+	ticker := time.NewTicker(a.statsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		stats := a.counters.snapshot()
+
+		if a.statsOutput == statsLog {
+			// Stats are expected regularly, so they bypass rate limiting.
+			if logger.enabled(levelInfo) {
+				log.Println(levelNames[levelInfo], "logstash_stats:", stats)
+			}
+			continue
+		}
+
+		event := messagePool.Get().(*Message)
+		*event = Message{
+			Message:     statsType,
+			Host:        a.hostname,
+			Environment: a.environment,
+			Type:        statsType,
+			Fields:      stats.fields(),
+			Timestamp:   time.Now(),
+		}
+
+		select {
+		case events <- event:
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package logstash
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syslogFacilities and syslogSeverities name the parts of a syslog priority.
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var syslogSeverities = []string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+// syslogLine is an application log line parsed as syslog.
+type syslogLine struct {
+	priority  int // -1 when the line has no priority
+	timestamp string
+	hostname  string
+	program   string
+	pid       string
+	message   string
+}
+
+// parseSyslog parses an RFC 5424 or RFC 3164 style line. Lines without a
+// priority are only accepted when they start with an RFC 3164 timestamp.
+func parseSyslog(line string) (syslogLine, bool) {
+	parsed := syslogLine{priority: -1}
+	rest := line
+
+	if strings.HasPrefix(rest, "<") {
+		end := strings.IndexByte(rest, '>')
+		if end < 2 || end > 4 {
+			return parsed, false
+		}
+		priority, err := strconv.Atoi(rest[1:end])
+		if err != nil || priority < 0 || priority > 191 {
+			return parsed, false
+		}
+		parsed.priority = priority
+		rest = rest[end+1:]
+
+		if strings.HasPrefix(rest, "1 ") {
+			return parseRFC5424(parsed, rest[2:])
+		}
+	}
+
+	return parseRFC3164(parsed, rest)
+}
+
+// parseRFC5424 parses the part of an RFC 5424 line after the version.
+func parseRFC5424(parsed syslogLine, rest string) (syslogLine, bool) {
+	parts := strings.SplitN(rest, " ", 6)
+	if len(parts) < 5 {
+		return parsed, false
+	}
+
+	parsed.timestamp = syslogNil(parts[0])
+	parsed.hostname = syslogNil(parts[1])
+	parsed.program = syslogNil(parts[2])
+	parsed.pid = syslogNil(parts[3])
+
+	if len(parts) == 6 {
+		parsed.message = skipStructuredData(parts[5])
+	}
+	parsed.message = strings.TrimPrefix(parsed.message, "\ufeff")
+
+	return parsed, true
+}
+
+// skipStructuredData returns the message following the structured data.
+func skipStructuredData(rest string) string {
+	if strings.HasPrefix(rest, "-") {
+		return strings.TrimPrefix(rest[1:], " ")
+	}
+
+	inQuote, escaped := false, false
+	for i := 0; i < len(rest); i++ {
+		c := rest[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			inQuote = !inQuote
+		case c == ']' && !inQuote:
+			// Another element may follow directly.
+			if i+1 < len(rest) && rest[i+1] == '[' {
+				continue
+			}
+			return strings.TrimPrefix(rest[i+1:], " ")
+		}
+	}
+
+	return ""
+}
+
+// parseRFC3164 parses "Mmm dd hh:mm:ss host tag[pid]: msg", where the
+// timestamp and host are optional when the line carried a priority.
+func parseRFC3164(parsed syslogLine, rest string) (syslogLine, bool) {
+	if len(rest) >= len(time.Stamp) {
+		if _, err := time.Parse(time.Stamp, rest[:len(time.Stamp)]); err == nil {
+			parsed.timestamp = rest[:len(time.Stamp)]
+			rest = strings.TrimPrefix(rest[len(time.Stamp):], " ")
+
+			if space := strings.IndexByte(rest, ' '); space > 0 {
+				parsed.hostname = rest[:space]
+				rest = rest[space+1:]
+			}
+		}
+	}
+
+	if parsed.priority < 0 && parsed.timestamp == "" {
+		return parsed, false
+	}
+
+	// The tag is at most 32 characters and ends at "[" or ":".
+	if colon := strings.Index(rest, ": "); colon > 0 && colon <= 40 && !strings.ContainsAny(rest[:colon], " \t") {
+		tag := rest[:colon]
+		if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+			parsed.pid = tag[open+1 : len(tag)-1]
+			tag = tag[:open]
+		}
+		parsed.program = tag
+		rest = rest[colon+2:]
+	}
+
+	parsed.message = rest
+	return parsed, true
+}
+
+// syslogNil maps the RFC 5424 nil value to an empty string.
+func syslogNil(value string) string {
+	if value == "-" {
+		return ""
+	}
+	return value
+}
+
+// applySyslog replaces the event's message with the parsed syslog message
+// and records the syslog header as fields.
+func applySyslog(event *Message) {
+	parsed, ok := parseSyslog(event.Message)
+	if !ok {
+		return
+	}
+
+	if parsed.priority >= 0 {
+		event.setField("syslog_pri", strconv.Itoa(parsed.priority))
+		if facility := parsed.priority / 8; facility < len(syslogFacilities) {
+			event.setField("syslog_facility", syslogFacilities[facility])
+		}
+		event.setField("syslog_severity", syslogSeverities[parsed.priority%8])
+	}
+	if parsed.timestamp != "" {
+		event.setField("syslog_timestamp", parsed.timestamp)
+	}
+	if parsed.hostname != "" {
+		event.setField("syslog_hostname", parsed.hostname)
+	}
+	if parsed.program != "" {
+		event.setField("syslog_program", parsed.program)
+	}
+	if parsed.pid != "" {
+		event.setField("syslog_pid", parsed.pid)
+	}
+
+	event.Message = parsed.message
+}
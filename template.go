@@ -0,0 +1,92 @@
+package logstash
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// compileTemplate parses a message or field template.
+func compileTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=zero").Parse(text)
+}
+
+// compileTemplates parses the config file's templates, keyed by output
+// field, and returns the non-message fields in a stable order.
+func compileTemplates(texts map[string]string) (map[string]*template.Template, []string, error) {
+	if len(texts) == 0 {
+		return nil, nil, nil
+	}
+
+	templates := make(map[string]*template.Template, len(texts))
+	var fields []string
+
+	for field, text := range texts {
+		if field == "" || (field != "message" && reservedFields[field]) {
+			return nil, nil, fmt.Errorf("invalid template field name: %q", field)
+		}
+
+		tmpl, err := compileTemplate(field, text)
+		if err != nil {
+			return nil, nil, err
+		}
+		templates[field] = tmpl
+
+		if field != "message" {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	return templates, fields, nil
+}
+
+// renderTemplate executes tmpl against the event.
+func renderTemplate(tmpl *template.Template, event *Message) (string, error) {
+	var out strings.Builder
+	if err := tmpl.Execute(&out, event); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// applyTemplates renders the field templates and the message template
+// against the event. All templates see the event as it was before any of
+// them ran. A template that fails leaves its field unchanged.
+func (a *Adapter) applyTemplates(event *Message, rules *rules) {
+	tmpl := a.template
+	if tmpl == nil {
+		tmpl = rules.templates["message"]
+	}
+
+	message := event.Message
+	if tmpl != nil {
+		value, err := renderTemplate(tmpl, event)
+		if err != nil {
+			logWarn("logstash_template:", err)
+		} else {
+			message = value
+		}
+	}
+
+	// Render every field before setting any, so all templates see the same event.
+	values := make([]string, len(rules.templateFields))
+	failed := make([]bool, len(rules.templateFields))
+	for i, name := range rules.templateFields {
+		value, err := renderTemplate(rules.templates[name], event)
+		if err != nil {
+			logWarn("logstash_template:", err)
+			failed[i] = true
+			continue
+		}
+		values[i] = value
+	}
+
+	event.Message = message
+	for i, name := range rules.templateFields {
+		if !failed[i] {
+			event.setField(name, values[i])
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package logstash
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timestampSearchLimit is how far into a line presets look for a timestamp.
+const timestampSearchLimit = 100
+
+// timestampPreset finds and parses one family of timestamp formats.
+type timestampPreset struct {
+	pattern *regexp.Regexp
+	layouts []string
+}
+
+// timestampPresets are the named formats accepted by timestamp_layouts.
+var timestampPresets = map[string]timestampPreset{
+	// 2006-01-02T15:04:05.000Z, 2006-01-02 15:04:05,000 (Java, Python)
+	"iso8601": {
+		pattern: regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?`),
+		layouts: []string{
+			"2006-01-02T15:04:05.999999999Z07:00",
+			"2006-01-02T15:04:05.999999999Z0700",
+			"2006-01-02T15:04:05.999999999",
+			"2006-01-02 15:04:05.999999999Z07:00",
+			"2006-01-02 15:04:05.999999999Z0700",
+			"2006-01-02 15:04:05.999999999",
+		},
+	},
+	// 02/Jan/2006:15:04:05 -0700 (Apache and nginx access logs)
+	"clf": {
+		pattern: regexp.MustCompile(`\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}`),
+		layouts: []string{"02/Jan/2006:15:04:05 -0700"},
+	},
+	// Jan _2 15:04:05
+	"syslog": {
+		pattern: regexp.MustCompile(`[A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2}`),
+		layouts: []string{time.Stamp},
+	},
+}
+
+// timestampParser extracts the time an application logged a line.
+type timestampParser struct {
+	presets []timestampPreset
+	layouts []customLayout
+	now     func() time.Time
+}
+
+// customLayout is a Go time layout matched at the start of a line. The
+// pattern finds the text the layout covers, which varies with names such as
+// Jan or Monday, optional fractions and unpadded numbers.
+type customLayout struct {
+	layout  string
+	pattern *regexp.Regexp
+}
+
+// timestampSample is the time custom layouts are checked with. Unlike the
+// reference time, its fields format differently from the layout elements.
+var timestampSample = time.Date(2017, time.November, 23, 21, 8, 37, 123456789, time.FixedZone("CET", 60*60))
+
+// newTimestampParser builds a parser from a list of preset names and Go
+// time layouts, or returns nil when the list is empty.
+func newTimestampParser(names []string) (*timestampParser, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	p := &timestampParser{now: time.Now}
+	for _, name := range names {
+		if preset, found := timestampPresets[name]; found {
+			p.presets = append(p.presets, preset)
+			continue
+		}
+
+		layout, err := compileLayout(name)
+		if err != nil {
+			return nil, errors.New("logstash: invalid timestamp_layouts: " + err.Error())
+		}
+		p.layouts = append(p.layouts, layout)
+	}
+
+	return p, nil
+}
+
+// compileLayout builds the pattern matching the text of name, which must be
+// a Go layout referring to the reference time. It is checked by formatting
+// and parsing a time with it.
+func compileLayout(name string) (customLayout, error) {
+	formatted := timestampSample.Format(name)
+	if _, err := time.Parse(name, formatted); err != nil {
+		return customLayout{}, errors.New("unknown preset or layout " + name + ": " + err.Error())
+	}
+
+	var pattern strings.Builder
+	pattern.WriteString(`^\[?(`)
+	elements := 0
+	for rest := name; rest != ""; {
+		var element string
+		element, rest = nextLayoutElement(rest)
+		if fragment, found := layoutFragments[element]; found {
+			pattern.WriteString(fragment)
+			elements++
+		} else if fragment := fractionFragment(element); fragment != "" {
+			pattern.WriteString(fragment)
+			elements++
+		} else if strings.TrimLeft(element, " ") == "" {
+			// Parse takes a run of spaces as matching any run of spaces.
+			pattern.WriteString(" +")
+		} else {
+			pattern.WriteString(regexp.QuoteMeta(element))
+		}
+
+		// Parse accepts fractional seconds the layout doesn't have.
+		if (element == "05" || element == "5") && fractionFragment(peekLayoutElement(rest)) == "" {
+			pattern.WriteString(`(?:[.,]\d+)?`)
+		}
+	}
+	pattern.WriteString(")")
+
+	if elements == 0 {
+		return customLayout{}, errors.New("unknown preset or layout " + name)
+	}
+
+	layout := customLayout{layout: name, pattern: regexp.MustCompile(pattern.String())}
+	if match := layout.pattern.FindStringSubmatch(formatted); match == nil || match[1] != formatted {
+		return customLayout{}, errors.New("unsupported layout " + name)
+	}
+	return layout, nil
+}
+
+// layoutFragments are the patterns of the layout elements, as Parse reads
+// them: padded numbers have a fixed width, unpadded ones one or two digits.
+var layoutFragments = map[string]string{
+	"January":   `[A-Z][a-z]{2,8}`,
+	"Jan":       `[A-Z][a-z]{2}`,
+	"Monday":    `[A-Z][a-z]{5,8}`,
+	"Mon":       `[A-Z][a-z]{2}`,
+	"MST":       `[A-Z]{3,5}(?:[+-]\d{1,2})?`,
+	"2006":      `\d{4}`,
+	"06":        `\d{2}`,
+	"01":        `\d{2}`,
+	"1":         `\d{1,2}`,
+	"02":        `\d{2}`,
+	"2":         `\d{1,2}`,
+	"_2":        ` ?\d{1,2}`,
+	"002":       `\d{3}`,
+	"__2":       `[ \d]{2}\d`,
+	"15":        `\d{1,2}`,
+	"03":        `\d{2}`,
+	"3":         `\d{1,2}`,
+	"04":        `\d{2}`,
+	"4":         `\d{1,2}`,
+	"05":        `\d{2}`,
+	"5":         `\d{1,2}`,
+	"PM":        `[AP]M`,
+	"pm":        `[ap]m`,
+	"-070000":   `[+-]\d{6}`,
+	"-07:00:00": `[+-]\d{2}:\d{2}:\d{2}`,
+	"-0700":     `[+-]\d{4}`,
+	"-07:00":    `[+-]\d{2}:\d{2}`,
+	"-07":       `[+-]\d{2}`,
+	"Z070000":   `(?:Z|[+-]\d{6})`,
+	"Z07:00:00": `(?:Z|[+-]\d{2}:\d{2}:\d{2})`,
+	"Z0700":     `(?:Z|[+-]\d{4})`,
+	"Z07:00":    `(?:Z|[+-]\d{2}:\d{2})`,
+	"Z07":       `(?:Z|[+-]\d{2})`,
+}
+
+// layoutElements are the elements of Go layouts, longest first where one is
+// the prefix of another.
+var layoutElements = []string{
+	"January", "Jan", "Monday", "Mon", "MST",
+	"2006", "002", "01", "02", "03", "04", "05", "06",
+	"15", "1", "2", "3", "4", "5", "__2", "_2",
+	"PM", "pm",
+	"-07:00:00", "-070000", "-07:00", "-0700", "-07",
+	"Z07:00:00", "Z070000", "Z07:00", "Z0700", "Z07",
+}
+
+// nextLayoutElement splits the first element off layout: a layout element,
+// a fractional second such as .000 or ,999, a run of spaces or a single
+// literal byte.
+func nextLayoutElement(layout string) (string, string) {
+	if layout[0] == '.' || layout[0] == ',' {
+		end := 1
+		for end < len(layout) && layout[end] == layout[1] && (layout[1] == '0' || layout[1] == '9') {
+			end++
+		}
+		if end > 1 && (end == len(layout) || layout[end] < '0' || layout[end] > '9') {
+			return layout[:end], layout[end:]
+		}
+	}
+
+	// As in Parse, _2006 is a literal underscore followed by the year.
+	if strings.HasPrefix(layout, "_2006") {
+		return "_", layout[1:]
+	}
+
+	for _, element := range layoutElements {
+		if strings.HasPrefix(layout, element) {
+			return element, layout[len(element):]
+		}
+	}
+
+	end := 1
+	if layout[0] == ' ' {
+		for end < len(layout) && layout[end] == ' ' {
+			end++
+		}
+	}
+	return layout[:end], layout[end:]
+}
+
+// peekLayoutElement returns the first element of layout, or "".
+func peekLayoutElement(layout string) string {
+	if layout == "" {
+		return ""
+	}
+	element, _ := nextLayoutElement(layout)
+	return element
+}
+
+// fractionFragment returns the pattern of a fractional second element, or
+// "" if element isn't one. .000 needs exactly as many digits, .999 any.
+func fractionFragment(element string) string {
+	if len(element) < 2 || (element[0] != '.' && element[0] != ',') {
+		return ""
+	}
+	separator := regexp.QuoteMeta(element[:1])
+	if element[1] == '9' {
+		return `(?:` + separator + `\d+)?`
+	}
+	return separator + `\d{` + strconv.Itoa(len(element)-1) + `}`
+}
+
+// parse returns the first timestamp found in message.
+func (p *timestampParser) parse(message string) (time.Time, bool) {
+	for _, layout := range p.layouts {
+		// Layouts are matched at the start of the line, or just inside a
+		// leading bracket as in "[2006-01-02 15:04:05] ...".
+		match := layout.pattern.FindStringSubmatch(message)
+		if match == nil {
+			continue
+		}
+		if t, err := time.Parse(layout.layout, match[1]); err == nil {
+			return p.complete(t), true
+		}
+	}
+
+	head := message
+	if len(head) > timestampSearchLimit {
+		head = head[:timestampSearchLimit]
+	}
+
+	for _, preset := range p.presets {
+		match := preset.pattern.FindString(head)
+		if match == "" {
+			continue
+		}
+
+		// Go only accepts a dot before fractional seconds.
+		match = strings.Replace(match, ",", ".", 1)
+		for _, layout := range preset.layouts {
+			if t, err := time.Parse(layout, match); err == nil {
+				return p.complete(t), true
+			}
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// complete fills in the year for formats that omit it, picking the most
+// recent year that doesn't put the time in the future.
+func (p *timestampParser) complete(t time.Time) time.Time {
+	if t.Year() != 0 {
+		return t
+	}
+
+	now := p.now()
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+
+	return t
+}
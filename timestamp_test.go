@@ -0,0 +1,123 @@
+package logstash
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimestampLayouts(t *testing.T) {
+	cases := []struct {
+		layout  string
+		message string
+		want    time.Time
+	}{
+		{"2006-01-02T15:04:05Z07:00", "2024-05-01T12:00:00Z GET /", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+		{"2006-01-02T15:04:05Z07:00", "2024-05-01T12:00:00+02:00 GET /", time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{"2006-01-02 15:04:05.999", "2024-05-01 12:00:00 started", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+		{"2006-01-02 15:04:05.999", "2024-05-01 12:00:00.5 started", time.Date(2024, 5, 1, 12, 0, 0, 5e8, time.UTC)},
+		{"2006-01-02 15:04:05", "2024-05-01 12:00:00.250 started", time.Date(2024, 5, 1, 12, 0, 0, 25e7, time.UTC)},
+		{"2006-01-02 15:04:05,000", "2024-05-01 12:00:00,250 INFO", time.Date(2024, 5, 1, 12, 0, 0, 25e7, time.UTC)},
+		{"January 2 2006 15:04", "September 9 2024 08:30 up", time.Date(2024, 9, 9, 8, 30, 0, 0, time.UTC)},
+		{"January 2 2006 15:04", "May 19 2024 08:30 up", time.Date(2024, 5, 19, 8, 30, 0, 0, time.UTC)},
+		{"Monday Jan _2 15:04:05 2006", "Wednesday May  1 12:00:00 2024 x", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+		{"Mon Jan _2 15:04:05 2006", "Fri May 17 12:00:00 2024 x", time.Date(2024, 5, 17, 12, 0, 0, 0, time.UTC)},
+		{"1/2/2006 3:04:05 PM", "5/1/2024 3:07:09 PM done", time.Date(2024, 5, 1, 15, 7, 9, 0, time.UTC)},
+		{"1/2/2006 3:04:05 PM", "12/31/2024 11:07:09 AM done", time.Date(2024, 12, 31, 11, 7, 9, 0, time.UTC)},
+		{"20060102T150405", "[20240501T120000] tick", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+		{"02 Jan 06 15:04 MST", "01 May 24 12:00 UTC ok", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		p, err := newTimestampParser([]string{c.layout})
+		if err != nil {
+			t.Fatalf("%s: %v", c.layout, err)
+		}
+		got, ok := p.parse(c.message)
+		if !ok {
+			t.Errorf("%s: no timestamp found in %q", c.layout, c.message)
+			continue
+		}
+		if !got.Equal(c.want) {
+			t.Errorf("%s: parse(%q) = %v, want %v", c.layout, c.message, got, c.want)
+		}
+	}
+}
+
+// TestTimestampLayoutRoundTrip formats times with each layout and checks
+// they are parsed back from the start of a line.
+func TestTimestampLayoutRoundTrip(t *testing.T) {
+	layouts := []string{
+		time.ANSIC, time.RFC1123Z, time.RFC3339, time.RFC3339Nano, time.RFC822Z,
+		time.Kitchen, time.StampMicro, "2006-01-02 15:04:05.000000",
+		"_2/Jan/2006:15:04:05 -0700", "2006-002 15:04", "Monday, 02-Jan-06 15:04:05 -07:00:00",
+	}
+	times := []time.Time{
+		time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 9, 5, 9, 5, 7, 123456000, time.FixedZone("", 5*60*60+30*60)),
+		time.Date(2023, 12, 31, 23, 59, 59, 999999000, time.FixedZone("", -8*60*60)),
+	}
+
+	for _, layout := range layouts {
+		p, err := newTimestampParser([]string{layout})
+		if err != nil {
+			t.Fatalf("%s: %v", layout, err)
+		}
+		p.now = func() time.Time { return time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC) }
+
+		for _, want := range times {
+			message := want.Format(layout) + " rest of the line"
+			got, ok := p.parse(message)
+			if !ok {
+				t.Errorf("%s: no timestamp found in %q", layout, message)
+				continue
+			}
+			if formatted := got.Format(layout); formatted != want.Format(layout) {
+				t.Errorf("%s: parse(%q) formats as %q", layout, message, formatted)
+			}
+		}
+	}
+}
+
+func TestTimestampLayoutValidation(t *testing.T) {
+	for _, layout := range []string{"hello", "yyyy-mm-dd", "15 bis", "2006-01-02"} {
+		_, err := newTimestampParser([]string{layout})
+		if valid := layout == "15 bis" || layout == "2006-01-02"; valid != (err == nil) {
+			t.Errorf("newTimestampParser(%q) error = %v", layout, err)
+		}
+	}
+
+	if _, err := newTimestampParser([]string{"iso8601", "yyyy"}); err == nil || !strings.Contains(err.Error(), "yyyy") {
+		t.Errorf("the error doesn't name the layout: %v", err)
+	}
+}
+
+func TestTimestampPresets(t *testing.T) {
+	p, err := newTimestampParser([]string{"iso8601", "clf", "syslog"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.now = func() time.Time { return time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC) }
+
+	cases := []struct {
+		message string
+		want    time.Time
+	}{
+		{"level=info ts=2024-05-01T12:00:00.5+02:00 msg=up", time.Date(2024, 5, 1, 10, 0, 0, 5e8, time.UTC)},
+		{"2024-05-01 12:00:00,250 INFO app", time.Date(2024, 5, 1, 12, 0, 0, 25e7, time.UTC)},
+		{`10.0.0.1 - - [01/May/2024:12:00:00 +0000] "GET / HTTP/1.1" 200`, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+		{"May  1 12:00:00 host app[1]: up", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+		{"Dec 31 23:00:00 host app[1]: last year", time.Date(2023, 12, 31, 23, 0, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		got, ok := p.parse(c.message)
+		if !ok || !got.Equal(c.want) {
+			t.Errorf("parse(%q) = %v, %v, want %v", c.message, got, ok, c.want)
+		}
+	}
+
+	if _, ok := p.parse("no time here"); ok {
+		t.Error("found a timestamp in a line without one")
+	}
+}
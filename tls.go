@@ -0,0 +1,225 @@
+package logstash
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// defaultTLSReload is how often client certificate files are checked for
+// changes when a certificate is configured.
+const defaultTLSReload = time.Minute
+
+func init() {
+	router.AdapterTransports.Register(new(mtlsTransport), "mtls")
+}
+
+// mtlsTransport dials Logstash over TLS with optional client certificates.
+type mtlsTransport struct{}
+
+// Dial implements the router.AdapterTransport interface.
+func (t *mtlsTransport) Dial(addr string, options map[string]string) (net.Conn, error) {
+	reload, err := durationOption(options, "tls_reload", defaultTLSReload)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &mtlsConn{
+		addr:     addr,
+		options:  options,
+		reload:   reload,
+		certFile: options["tls_cert"],
+	}
+
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// newTLSConfig builds the client TLS configuration from the route options.
+func newTLSConfig(addr string, options map[string]string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	config := &tls.Config{
+		ServerName: host,
+	}
+
+	if ca := options["tls_ca"]; ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("logstash_tls: no certificates found in " + ca)
+		}
+		config.RootCAs = pool
+	}
+
+	certFile, keyFile := options["tls_cert"], options["tls_key"]
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("logstash_tls: tls_cert and tls_key must be set together")
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// mtlsConn is a TLS connection that reconnects with fresh credentials when
+// the client certificate file changes, so short-lived certificates keep
+// working without restarting logspout.
+type mtlsConn struct {
+	addr     string
+	options  map[string]string
+	reload   time.Duration
+	certFile string
+
+	mu        sync.Mutex
+	conn      net.Conn
+	modified  time.Time
+	lastCheck time.Time
+
+	// The deadlines set by the caller, applied to the connections that
+	// replace the current one.
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// connect loads the credentials and dials a new connection.
+func (c *mtlsConn) connect() error {
+	modified := modTime(c.certFile)
+
+	config, err := newTLSConfig(c.addr, c.options)
+	if err != nil {
+		return err
+	}
+
+	d, err := newDialer(c.options)
+	if err != nil {
+		return err
+	}
+
+	raw, err := d.dial(c.addr)
+	if err != nil {
+		return err
+	}
+
+	conn := tls.Client(raw, config)
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := conn.Handshake(); err != nil {
+		raw.Close()
+		return err
+	}
+	conn.SetReadDeadline(c.readDeadline)
+	conn.SetWriteDeadline(c.writeDeadline)
+
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn = conn
+	c.modified = modified
+	c.lastCheck = time.Now()
+
+	return nil
+}
+
+// Write implements net.Conn, first reconnecting if the certificate changed.
+func (c *mtlsConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.certFile != "" && time.Since(c.lastCheck) >= c.reload {
+		c.lastCheck = time.Now()
+
+		if !modTime(c.certFile).Equal(c.modified) {
+			if err := c.connect(); err != nil {
+				// Keep using the current connection until the new
+				// credentials load.
+				logWarn("logstash_tls: reload failed:", err)
+			} else {
+				logInfo("logstash_tls: reloaded client certificate", c.certFile)
+			}
+		}
+	}
+
+	return c.conn.Write(p)
+}
+
+// Read implements net.Conn.
+func (c *mtlsConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	return conn.Read(p)
+}
+
+// Close implements net.Conn.
+func (c *mtlsConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn.Close()
+}
+
+// LocalAddr implements net.Conn.
+func (c *mtlsConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn.
+func (c *mtlsConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline implements net.Conn.
+func (c *mtlsConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline, c.writeDeadline = t, t
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *mtlsConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *mtlsConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+	return c.conn.SetWriteDeadline(t)
+}
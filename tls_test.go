@@ -0,0 +1,186 @@
+package logstash
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for name.
+func (ca *testCA) issue(t *testing.T, name string, serial int64) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeClientCert writes a client certificate and key for name, dated at
+// modified so a rotation is seen however coarse the file times are.
+func writeClientCert(t *testing.T, ca *testCA, dir, name string, serial int64, modified time.Time) {
+	cert, key := ca.issue(t, name, serial)
+	for file, data := range map[string][]byte{"client.crt": cert, "client.key": key} {
+		path := filepath.Join(dir, file)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestMTLSReload checks that a rotated client certificate is used by the
+// next write, on a connection that keeps the write deadline set before it.
+func TestMTLSReload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, ca.pem, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	serverCert, serverKey := ca.issue(t, "127.0.0.1", 2)
+	cert, err := tls.X509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.pem)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// The client certificate names of the connections that sent data.
+	clients := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn *tls.Conn) {
+				defer conn.Close()
+				if _, err := conn.Read(make([]byte, 64)); err != nil {
+					return
+				}
+				clients <- conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}(conn.(*tls.Conn))
+		}
+	}()
+
+	modified := time.Now().Add(-time.Hour)
+	writeClientCert(t, ca, dir, "client-1", 3, modified)
+
+	conn, err := (&mtlsTransport{}).Dial(ln.Addr().String(), map[string]string{
+		"tls_ca":     caFile,
+		"tls_cert":   filepath.Join(dir, "client.crt"),
+		"tls_key":    filepath.Join(dir, "client.key"),
+		"tls_reload": "1ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	receivedFrom := func(want string) {
+		t.Helper()
+		select {
+		case name := <-clients:
+			if name != want {
+				t.Errorf("event sent with the certificate of %s, want %s", name, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("event not received")
+		}
+	}
+
+	if _, err := conn.Write([]byte("one\n")); err != nil {
+		t.Fatal(err)
+	}
+	receivedFrom("client-1")
+
+	writeClientCert(t, ca, dir, "client-2", 4, modified.Add(time.Minute))
+	time.Sleep(5 * time.Millisecond)
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("two\n")); err != nil {
+		t.Fatal(err)
+	}
+	receivedFrom("client-2")
+
+	// A deadline that has passed fails the write on the new connection too.
+	writeClientCert(t, ca, dir, "client-3", 5, modified.Add(2*time.Minute))
+	time.Sleep(5 * time.Millisecond)
+	conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	_, err = conn.Write([]byte("three\n"))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("write error = %v, want the deadline to apply after the reload", err)
+	}
+}
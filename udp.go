@@ -0,0 +1,29 @@
+package logstash
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// setSendBuffer sets SO_SNDBUF on a UDP connection and logs the size the
+// kernel actually applied, which may be clamped or doubled.
+func setSendBuffer(conn net.Conn, size int) error {
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		return errors.New("logstash: send_buffer is only supported for UDP")
+	}
+
+	if err := udp.SetWriteBuffer(size); err != nil {
+		return err
+	}
+
+	effective, err := sendBufferSize(udp)
+	if err != nil {
+		logWarn("logstash: unable to read UDP send buffer size:", err)
+		return nil
+	}
+
+	logInfo(fmt.Sprintf("logstash: UDP send buffer requested %d bytes, effective %d bytes", size, effective))
+	return nil
+}
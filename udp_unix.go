@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package logstash
+
+import (
+	"net"
+	"syscall"
+)
+
+// sendBufferSize reads back SO_SNDBUF from the socket.
+func sendBufferSize(conn *net.UDPConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		size, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return size, sockErr
+}
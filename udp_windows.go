@@ -0,0 +1,11 @@
+package logstash
+
+import (
+	"errors"
+	"net"
+)
+
+// sendBufferSize is not implemented on Windows.
+func sendBufferSize(conn *net.UDPConn) (int, error) {
+	return 0, errors.New("not supported on windows")
+}
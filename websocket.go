@@ -0,0 +1,422 @@
+package logstash
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// wsGUID is the fixed key suffix from RFC 6455 section 1.3.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsMaxFrame caps the size of frames accepted from the server.
+const wsMaxFrame = 1 << 20
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+func init() {
+	router.AdapterTransports.Register(&wsTransport{secure: false}, "ws")
+	router.AdapterTransports.Register(&wsTransport{secure: true}, "wss")
+}
+
+// wsTransport dials a WebSocket endpoint and sends every write as a text frame.
+type wsTransport struct {
+	secure bool
+}
+
+// Dial implements the router.AdapterTransport interface.
+func (t *wsTransport) Dial(addr string, options map[string]string) (net.Conn, error) {
+	c := &wsConn{
+		addr:         addr,
+		secure:       t.secure,
+		options:      options,
+		path:         "/",
+		pingInterval: 30 * time.Second,
+		pongTimeout:  10 * time.Second,
+		done:         make(chan struct{}),
+	}
+
+	if path := options["ws_path"]; path != "" {
+		c.path = path
+	}
+
+	var err error
+	if c.pingInterval, err = durationOption(options, "ws_ping_interval", c.pingInterval); err != nil {
+		return nil, err
+	}
+	if c.pongTimeout, err = durationOption(options, "ws_pong_timeout", c.pongTimeout); err != nil {
+		return nil, err
+	}
+
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+
+	go c.keepalive()
+
+	return c, nil
+}
+
+// wsConn is a client WebSocket connection. Once the connection is lost every
+// write fails, so the sender re-dials it with its backoff.
+type wsConn struct {
+	addr         string
+	secure       bool
+	options      map[string]string
+	path         string
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+
+	mu       sync.Mutex
+	conn     net.Conn
+	lastPong time.Time
+	done     chan struct{}
+	closed   bool
+}
+
+// connect dials the endpoint and performs the opening handshake.
+// It is only called before c is shared.
+func (c *wsConn) connect() error {
+	d, err := newDialer(c.options)
+	if err != nil {
+		return err
+	}
+
+	conn, err := d.dial(c.addr)
+	if err != nil {
+		return err
+	}
+
+	if c.secure {
+		config, err := newTLSConfig(c.addr, c.options)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+
+		secure := tls.Client(conn, config)
+		secure.SetDeadline(time.Now().Add(dialTimeout))
+		if err := secure.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		secure.SetDeadline(time.Time{})
+		conn = secure
+	}
+
+	reader, err := c.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.conn = conn
+	c.lastPong = time.Now()
+	go c.read(conn, reader)
+
+	return nil
+}
+
+// handshake sends the HTTP upgrade request and validates the response.
+func (c *wsConn) handshake(conn net.Conn) (*bufio.Reader, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	scheme := "ws"
+	if c.secure {
+		scheme = "wss"
+	}
+	target := &url.URL{Scheme: scheme, Host: c.addr, Path: c.path}
+
+	req, err := http.NewRequest("GET", target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New("logstash_ws: unexpected handshake status: " + resp.Status)
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, errors.New("logstash_ws: invalid Sec-WebSocket-Accept header")
+	}
+
+	return reader, nil
+}
+
+// drop closes conn if it is still the active connection.
+// It must be called with c.mu held.
+func (c *wsConn) drop(conn net.Conn) {
+	if c.conn == conn && conn != nil {
+		conn.Close()
+		c.conn = nil
+	}
+}
+
+// read consumes frames from the server, answering pings and recording pongs.
+func (c *wsConn) read(conn net.Conn, reader *bufio.Reader) {
+	for {
+		op, payload, err := readFrame(reader)
+		if err != nil {
+			c.mu.Lock()
+			c.drop(conn)
+			c.mu.Unlock()
+			return
+		}
+
+		c.mu.Lock()
+		switch op {
+		case wsOpPing:
+			if c.conn == conn {
+				writeFrame(conn, wsOpPong, payload)
+			}
+		case wsOpPong:
+			if c.conn == conn {
+				c.lastPong = time.Now()
+			}
+		case wsOpClose:
+			c.drop(conn)
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+	}
+}
+
+// keepalive pings the server and drops the connection when pongs stop arriving.
+func (c *wsConn) keepalive() {
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		if c.conn != nil {
+			if time.Since(c.lastPong) > c.pingInterval+c.pongTimeout {
+				logWarn("logstash_ws: pong timeout, reconnecting")
+				c.drop(c.conn)
+			} else if err := writeFrame(c.conn, wsOpPing, nil); err != nil {
+				logWarn("logstash_ws:", err)
+				c.drop(c.conn)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Write sends p as a single text frame, dropping the connection if the
+// write fails.
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, errors.New("logstash_ws: use of closed connection")
+	}
+	if c.conn == nil {
+		return 0, errors.New("logstash_ws: connection lost")
+	}
+
+	if err := writeFrame(c.conn, wsOpText, p); err != nil {
+		c.drop(c.conn)
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Read is not supported; the adapter only writes to Logstash.
+func (c *wsConn) Read(p []byte) (int, error) {
+	return 0, errors.New("logstash_ws: read not supported")
+}
+
+// Close sends a close frame and shuts down the connection.
+func (c *wsConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+
+	if c.conn != nil {
+		writeFrame(c.conn, wsOpClose, nil)
+		c.drop(c.conn)
+	}
+
+	return nil
+}
+
+// LocalAddr implements net.Conn.
+func (c *wsConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn.
+func (c *wsConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline implements net.Conn.
+func (c *wsConn) SetDeadline(t time.Time) error {
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.SetWriteDeadline(t)
+}
+
+// writeFrame writes a single masked, unfragmented client frame.
+func writeFrame(w io.Writer, op byte, payload []byte) error {
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|op)
+
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xFFFF:
+		var size [2]byte
+		binary.BigEndian.PutUint16(size[:], uint16(n))
+		frame = append(frame, 0x80|126)
+		frame = append(frame, size[:]...)
+	default:
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(n))
+		frame = append(frame, 0x80|127)
+		frame = append(frame, size[:]...)
+	}
+
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads a single frame from the server.
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	op := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(size[:]))
+	case 127:
+		var size [8]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(size[:])
+	}
+
+	if length > wsMaxFrame {
+		return 0, nil, errors.New("logstash_ws: frame too large")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return op, payload, nil
+}
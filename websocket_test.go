@@ -0,0 +1,121 @@
+package logstash
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsServer accepts one WebSocket connection and hands over its reader.
+func wsServer(t *testing.T, path string) (net.Listener, <-chan *bufio.ReadWriter, <-chan net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streams := make(chan *bufio.ReadWriter, 1)
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		reader := bufio.NewReader(conn)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			t.Error(err)
+			conn.Close()
+			return
+		}
+		if req.URL.Path != path || req.Header.Get("Upgrade") != "websocket" || req.Header.Get("Sec-WebSocket-Version") != "13" {
+			t.Errorf("unexpected upgrade request %s %v", req.URL, req.Header)
+		}
+
+		sum := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + wsGUID))
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"))
+
+		streams <- bufio.NewReadWriter(reader, bufio.NewWriter(conn))
+		conns <- conn
+	}()
+
+	return ln, streams, conns
+}
+
+func TestWebSocketRoundTrip(t *testing.T) {
+	ln, streams, conns := wsServer(t, "/events")
+	defer ln.Close()
+
+	conn, err := (&wsTransport{}).Dial(ln.Addr().String(), map[string]string{"ws_path": "/events"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	stream := <-streams
+	server := <-conns
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Payloads around the 7 and 16 bit length encodings.
+	for _, size := range []int{0, 125, 126, 65535, 65536} {
+		payload := strings.Repeat("x", size)
+		if _, err := conn.Write([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+
+		op, got, err := readFrame(stream.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != wsOpText || string(got) != payload {
+			t.Errorf("got op %d with %d bytes, want a text frame of %d bytes", op, len(got), size)
+		}
+	}
+
+	// The server's ping is answered with a pong carrying its payload.
+	stream.Write([]byte{0x80 | wsOpPing, 4, 'p', 'i', 'n', 'g'})
+	stream.Flush()
+	op, payload, err := readFrame(stream.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op != wsOpPong || string(payload) != "ping" {
+		t.Errorf("got op %d %q, want a pong", op, payload)
+	}
+}
+
+// TestWebSocketLost checks that writes fail once the server has gone, so the
+// sender re-dials.
+func TestWebSocketLost(t *testing.T) {
+	ln, _, conns := wsServer(t, "/")
+	defer ln.Close()
+
+	conn, err := (&wsTransport{}).Dial(ln.Addr().String(), map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	(<-conns).Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := conn.Write([]byte("event")); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("writes still succeed after the server closed the connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := conn.Write([]byte("event")); err == nil || !strings.Contains(err.Error(), "connection lost") {
+		t.Errorf("write error = %v, want connection lost", err)
+	}
+}
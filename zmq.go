@@ -0,0 +1,475 @@
+package logstash
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// ZeroMQ socket types selectable with the zmq_socket option.
+const (
+	zmqPush = "push"
+	zmqPub  = "pub"
+)
+
+// defaultZMQHWM is the high-water mark, ZeroMQ's default.
+const defaultZMQHWM = 1000
+
+// defaultZMQTimeout bounds each message write when write_timeout isn't set,
+// so a stalled peer can't block sending or Close forever.
+const defaultZMQTimeout = 10 * time.Second
+
+// Frame flags of ZMTP 3.0, the ZeroMQ wire protocol.
+const (
+	zmtpMore    = 0x01
+	zmtpLong    = 0x02
+	zmtpCommand = 0x04
+)
+
+// zmqPeers are the socket types each socket type can talk to.
+var zmqPeers = map[string][]string{
+	zmqPush: {"PULL"},
+	zmqPub:  {"SUB", "XSUB"},
+}
+
+func init() {
+	router.AdapterTransports.Register(new(zmqTransport), "zmq")
+}
+
+// zmqTransport publishes events on a ZeroMQ PUSH or PUB socket connected to
+// a bound PULL or SUB socket, such as Logstash's zeromq input. It speaks
+// ZMTP 3.0 with the NULL security mechanism over TCP.
+type zmqTransport struct{}
+
+// Dial implements the router.AdapterTransport interface.
+func (t *zmqTransport) Dial(addr string, options map[string]string) (net.Conn, error) {
+	socketType, err := enumOption(options, "zmq_socket", zmqPush, zmqPush, zmqPub)
+	if err != nil {
+		return nil, err
+	}
+	hwm, err := intOption(options, "zmq_hwm", defaultZMQHWM)
+	if err != nil {
+		return nil, err
+	}
+	if options["zmq_topic"] != "" && socketType != zmqPub {
+		return nil, errors.New("logstash: zmq_topic requires zmq_socket=pub")
+	}
+	writeTimeout, err := durationOption(options, "write_timeout", defaultZMQTimeout)
+	if err != nil {
+		return nil, err
+	}
+	d, err := newDialer(options)
+	if err != nil {
+		return nil, err
+	}
+	backoff, err := newBackoff(options)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &zmqConn{
+		addr:         addr,
+		dialer:       d,
+		backoff:      backoff,
+		writeTimeout: writeTimeout,
+		socketType:   socketType,
+		topic:        options["zmq_topic"],
+		queue:        make(chan []byte, hwm),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+
+	go c.run()
+
+	return c, nil
+}
+
+// zmqConn queues events up to the high-water mark and sends them from its
+// own goroutine, reconnecting when the connection is lost. As with ZeroMQ,
+// a PUB socket drops events when the queue is full while a PUSH socket
+// blocks until there is room.
+//
+// The sender's write deadlines don't reach the queued messages, so
+// write_timeout is applied to each message as it is sent instead; on a PUSH
+// socket the deadline bounds the wait for room in the queue.
+type zmqConn struct {
+	addr         string
+	dialer       *dialer
+	backoff      *backoff
+	writeTimeout time.Duration
+	socketType   string
+	topic        string
+
+	conn    net.Conn
+	queue   chan []byte
+	done    chan struct{}
+	stopped chan struct{}
+
+	// writeDeadline is set and read by the sender's goroutine only.
+	writeDeadline time.Time
+
+	dropped   uint64
+	closeOnce sync.Once
+}
+
+// connect dials the peer and performs the ZMTP handshake.
+// It is only called before c is shared, and from run.
+func (c *zmqConn) connect() error {
+	conn, err := c.dialer.dial(c.addr)
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := c.handshake(conn); err != nil {
+		conn.Close()
+		return errors.New("logstash_zmq: handshake with " + c.addr + " failed: " + err.Error())
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Subscriptions from SUB peers aren't needed, as every event is sent,
+	// but they must be read. The read fails once the connection is gone.
+	go io.Copy(ioutil.Discard, conn)
+
+	c.conn = conn
+	return nil
+}
+
+// handshake exchanges the greeting and READY commands.
+func (c *zmqConn) handshake(conn net.Conn) error {
+	var greeting [64]byte
+	greeting[0], greeting[9] = 0xff, 0x7f
+	greeting[10], greeting[11] = 3, 0
+	copy(greeting[12:32], "NULL")
+
+	ready := zmtpReady(c.socketType)
+	if _, err := conn.Write(append(greeting[:], ready...)); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	var peer [64]byte
+	if _, err := io.ReadFull(reader, peer[:]); err != nil {
+		return err
+	}
+	if peer[0] != 0xff || peer[9] != 0x7f || peer[10] < 3 {
+		return errors.New("peer does not speak ZMTP 3")
+	}
+	if string(trimNUL(peer[12:32])) != "NULL" {
+		return errors.New("peer requires the " + string(trimNUL(peer[12:32])) + " security mechanism")
+	}
+
+	flags, body, err := readZMTPFrame(reader)
+	if err != nil {
+		return err
+	}
+	if flags&zmtpCommand == 0 || len(body) < 1 || len(body) < 1+int(body[0]) {
+		return errors.New("expected a READY command")
+	}
+
+	name := string(body[1 : 1+int(body[0])])
+	if name == "ERROR" {
+		return errors.New("peer refused the connection")
+	}
+	if name != "READY" {
+		return errors.New("expected a READY command, got " + name)
+	}
+
+	peerType := zmtpProperty(body[1+int(body[0]):], "Socket-Type")
+	for _, allowed := range zmqPeers[c.socketType] {
+		if peerType == allowed {
+			return nil
+		}
+	}
+	return errors.New("a " + c.socketType + " socket can't talk to a " + peerType + " socket")
+}
+
+// zmtpReady builds the READY command announcing the socket type.
+func zmtpReady(socketType string) []byte {
+	value := []byte(zmqSocketTypes[socketType])
+
+	body := []byte{5}
+	body = append(body, "READY"...)
+	body = append(body, byte(len("Socket-Type")))
+	body = append(body, "Socket-Type"...)
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(value)))
+	body = append(body, size[:]...)
+	body = append(body, value...)
+
+	return append([]byte{zmtpCommand, byte(len(body))}, body...)
+}
+
+// zmqSocketTypes are the names of the socket types on the wire.
+var zmqSocketTypes = map[string]string{
+	zmqPush: "PUSH",
+	zmqPub:  "PUB",
+}
+
+// zmtpProperty returns a property of a READY command's metadata.
+func zmtpProperty(metadata []byte, name string) string {
+	for len(metadata) > 0 {
+		nameLength := int(metadata[0])
+		if len(metadata) < 1+nameLength+4 {
+			return ""
+		}
+		key := string(metadata[1 : 1+nameLength])
+		metadata = metadata[1+nameLength:]
+
+		valueLength := int(binary.BigEndian.Uint32(metadata))
+		if len(metadata) < 4+valueLength {
+			return ""
+		}
+		value := string(metadata[4 : 4+valueLength])
+		metadata = metadata[4+valueLength:]
+
+		if key == name {
+			return value
+		}
+	}
+	return ""
+}
+
+// readZMTPFrame reads one frame, returning its flags and body.
+func readZMTPFrame(reader *bufio.Reader) (byte, []byte, error) {
+	flags, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var size uint64
+	if flags&zmtpLong != 0 {
+		var long [8]byte
+		if _, err := io.ReadFull(reader, long[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(long[:])
+	} else {
+		short, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		size = uint64(short)
+	}
+
+	// Only the peer's READY command is read, which is small.
+	if size > 64*1024 {
+		return 0, nil, errors.New("frame too large")
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+	return flags, body, nil
+}
+
+// trimNUL removes the zero padding of a greeting field.
+func trimNUL(field []byte) []byte {
+	for i, b := range field {
+		if b == 0 {
+			return field[:i]
+		}
+	}
+	return field
+}
+
+// appendZMTPFrame appends a message frame to buf.
+func appendZMTPFrame(buf []byte, body []byte, more bool) []byte {
+	var flags byte
+	if more {
+		flags |= zmtpMore
+	}
+
+	if len(body) <= 255 {
+		buf = append(buf, flags, byte(len(body)))
+	} else {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(len(body)))
+		buf = append(buf, flags|zmtpLong)
+		buf = append(buf, size[:]...)
+	}
+
+	return append(buf, body...)
+}
+
+// Write implements net.Conn by queueing the event.
+func (c *zmqConn) Write(p []byte) (int, error) {
+	// The caller reuses p once Write returns.
+	event := append([]byte(nil), p...)
+
+	select {
+	case <-c.done:
+		return 0, errors.New("logstash_zmq: use of closed connection")
+	default:
+	}
+
+	if c.socketType == zmqPub {
+		select {
+		case c.queue <- event:
+		default:
+			dropped := atomic.AddUint64(&c.dropped, 1)
+			logWarn("logstash_zmq: high-water mark reached, dropped event, total:", dropped)
+		}
+		return len(p), nil
+	}
+
+	var timeout <-chan time.Time
+	if !c.writeDeadline.IsZero() {
+		timer := time.NewTimer(time.Until(c.writeDeadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case c.queue <- event:
+		return len(p), nil
+	case <-c.done:
+		return 0, errors.New("logstash_zmq: use of closed connection")
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// run sends the queued events until the connection is closed, then sends
+// whatever is still queued if it is connected.
+func (c *zmqConn) run() {
+	defer close(c.stopped)
+
+	var frame []byte
+	for {
+		var event []byte
+		select {
+		case event = <-c.queue:
+		case <-c.done:
+			c.drain(frame)
+			return
+		}
+
+		frame = c.frame(frame[:0], event)
+		if !c.send(frame) {
+			return
+		}
+	}
+}
+
+// frame encodes an event as a message, preceded by the topic on PUB
+// sockets that have one.
+func (c *zmqConn) frame(buf []byte, event []byte) []byte {
+	if c.topic != "" {
+		buf = appendZMTPFrame(buf, []byte(c.topic), true)
+	}
+	return appendZMTPFrame(buf, event, false)
+}
+
+// send writes a message, reconnecting until it is written. It returns
+// false if the connection was closed first.
+func (c *zmqConn) send(frame []byte) bool {
+	for failures := 0; ; failures++ {
+		if c.conn != nil {
+			err := c.write(frame)
+			if err == nil {
+				return true
+			}
+			logWarn("logstash_zmq:", err)
+			c.conn.Close()
+			c.conn = nil
+		}
+
+		if failures > 0 {
+			select {
+			case <-time.After(c.backoff.delay(failures)):
+			case <-c.done:
+				return false
+			}
+		}
+
+		if err := c.connect(); err != nil {
+			logWarn("logstash_zmq:", err)
+		}
+	}
+}
+
+// drain sends the queued events without reconnecting and closes the
+// connection.
+func (c *zmqConn) drain(frame []byte) {
+	if c.conn == nil {
+		return
+	}
+	defer c.conn.Close()
+
+	for {
+		select {
+		case event := <-c.queue:
+			frame = c.frame(frame[:0], event)
+			if err := c.write(frame); err != nil {
+				logError("logstash_zmq: closing with", len(c.queue)+1, "unsent events:", err)
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// write writes a message within the write timeout. A timed out write may
+// have sent part of the message, so the connection must then be replaced.
+func (c *zmqConn) write(frame []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Read is not supported; the adapter only writes.
+func (c *zmqConn) Read(p []byte) (int, error) {
+	return 0, errors.New("logstash_zmq: read not supported")
+}
+
+// Close sends the queued events and closes the connection.
+func (c *zmqConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	<-c.stopped
+	return nil
+}
+
+// LocalAddr implements net.Conn.
+func (c *zmqConn) LocalAddr() net.Addr {
+	return nil
+}
+
+// RemoteAddr implements net.Conn.
+func (c *zmqConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+// SetDeadline implements net.Conn.
+func (c *zmqConn) SetDeadline(t time.Time) error {
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *zmqConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn. It bounds how long Write waits for
+// room in a PUSH socket's queue.
+func (c *zmqConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline = t
+	return nil
+}
@@ -0,0 +1,216 @@
+package logstash
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// zmtpPeer is a fake bound ZeroMQ socket of the given type.
+type zmtpPeer struct {
+	ln       net.Listener
+	messages chan [][]byte
+	conns    chan net.Conn
+}
+
+// newZMTPPeer accepts one connection, performs the handshake and, unless
+// read is false, passes on the messages it receives.
+func newZMTPPeer(t *testing.T, socketType string, read bool) *zmtpPeer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &zmtpPeer{ln: ln, messages: make(chan [][]byte, 16), conns: make(chan net.Conn, 1)}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		p.conns <- conn
+		reader := bufio.NewReader(conn)
+
+		var greeting [64]byte
+		if _, err := io.ReadFull(reader, greeting[:]); err != nil {
+			t.Error(err)
+			return
+		}
+		if greeting[0] != 0xff || greeting[9] != 0x7f || greeting[10] != 3 || string(trimNUL(greeting[12:32])) != "NULL" {
+			t.Errorf("unexpected greeting % x", greeting)
+		}
+
+		var reply [64]byte
+		reply[0], reply[9], reply[10] = 0xff, 0x7f, 3
+		copy(reply[12:], "NULL")
+		conn.Write(reply[:])
+
+		flags, body, err := readZMTPFrame(reader)
+		if err != nil || flags&zmtpCommand == 0 || !strings.HasPrefix(string(body), "\x05READY") {
+			t.Errorf("expected a READY command, got %x %q %v", flags, body, err)
+			return
+		}
+		conn.Write(zmtpPeerReady(socketType))
+
+		if !read {
+			return
+		}
+		var message [][]byte
+		for {
+			flags, body, err := readZMTPFrame(reader)
+			if err != nil {
+				close(p.messages)
+				return
+			}
+			message = append(message, body)
+			if flags&zmtpMore == 0 {
+				p.messages <- message
+				message = nil
+			}
+		}
+	}()
+
+	return p
+}
+
+// zmtpPeerReady builds the READY command of a peer socket type.
+func zmtpPeerReady(socketType string) []byte {
+	body := append([]byte{5}, "READY"...)
+	body = append(body, byte(len("Socket-Type")))
+	body = append(body, "Socket-Type"...)
+	body = append(body, 0, 0, 0, byte(len(socketType)))
+	body = append(body, socketType...)
+	return append([]byte{zmtpCommand, byte(len(body))}, body...)
+}
+
+func TestZMQPushRoundTrip(t *testing.T) {
+	peer := newZMTPPeer(t, "PULL", true)
+	defer peer.ln.Close()
+
+	conn, err := (&zmqTransport{}).Dial(peer.ln.Addr().String(), map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bodies around the short and long frame encodings.
+	events := []string{"one", strings.Repeat("x", 255), strings.Repeat("y", 256)}
+	for _, event := range events {
+		if _, err := conn.Write([]byte(event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+
+	for _, event := range events {
+		select {
+		case message := <-peer.messages:
+			if len(message) != 1 || string(message[0]) != event {
+				t.Errorf("received %d frames starting %q, want %d bytes", len(message), message[0][:3], len(event))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not received")
+		}
+	}
+}
+
+func TestZMQPubTopic(t *testing.T) {
+	peer := newZMTPPeer(t, "SUB", true)
+	defer peer.ln.Close()
+
+	conn, err := (&zmqTransport{}).Dial(peer.ln.Addr().String(), map[string]string{"zmq_socket": "pub", "zmq_topic": "logs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("event"))
+	conn.Close()
+
+	select {
+	case message := <-peer.messages:
+		if len(message) != 2 || string(message[0]) != "logs" || string(message[1]) != "event" {
+			t.Errorf("received %q, want the topic and the event", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+}
+
+func TestZMQIncompatiblePeer(t *testing.T) {
+	peer := newZMTPPeer(t, "SUB", false)
+	defer peer.ln.Close()
+
+	_, err := (&zmqTransport{}).Dial(peer.ln.Addr().String(), map[string]string{"zmq_socket": "push"})
+	if err == nil || !strings.Contains(err.Error(), "can't talk to a SUB socket") {
+		t.Errorf("error = %v, want the socket types refused", err)
+	}
+}
+
+// TestZMQStalledPeer checks that write_timeout bounds the writes to a peer
+// that stops reading, so Close returns.
+func TestZMQStalledPeer(t *testing.T) {
+	peer := newZMTPPeer(t, "PULL", false)
+
+	conn, err := (&zmqTransport{}).Dial(peer.ln.Addr().String(), map[string]string{
+		"write_timeout": "50ms",
+		"zmq_hwm":       "8",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (<-peer.conns).Close()
+
+	// Reconnects are refused, so the queue is never sent.
+	peer.ln.Close()
+
+	event := []byte(strings.Repeat("x", 1<<20))
+	for i := 0; i < 8; i++ {
+		conn.Write(event)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		conn.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on the stalled peer")
+	}
+}
+
+// TestZMQFullQueueTimeout checks that a write to a PUSH socket whose queue
+// is full fails at the write deadline instead of blocking the sender.
+func TestZMQFullQueueTimeout(t *testing.T) {
+	peer := newZMTPPeer(t, "PULL", false)
+
+	conn, err := (&zmqTransport{}).Dial(peer.ln.Addr().String(), map[string]string{
+		"write_timeout": "50ms",
+		"zmq_hwm":       "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	(<-peer.conns).Close()
+	peer.ln.Close()
+	defer conn.Close()
+
+	// One event is held by the sending goroutine, which can't reconnect, and
+	// the queue fills with the next ones.
+	conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	var werr error
+	start := time.Now()
+	for i := 0; i < 100 && werr == nil; i++ {
+		_, werr = conn.Write([]byte("event"))
+	}
+	elapsed := time.Since(start)
+
+	if netErr, ok := werr.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("write error = %v, want a timeout", werr)
+	}
+	if elapsed < 40*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("write failed after %v, want the write deadline", elapsed)
+	}
+}